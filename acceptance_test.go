@@ -1,17 +1,23 @@
 package gode_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"gode"
+	"gode/casinoapi"
 	"gode/client"
+	"gode/games"
 	"gode/log"
+	"gode/metrics"
 	"gode/types"
 )
 
@@ -28,10 +34,11 @@ func TestClient(t *testing.T) {
 
 	t.Run("register client after login and unregister on disconnect", func(t *testing.T) {
 		spyAPI := &SpyAPI{
-			response: map[string]apiResponse{
+			queue: map[string][]apiResponse{
 				"loginCheck": {
-					result: []byte(LoginAPIResult),
-					err:    nil,
+					{result: loginResult(1325, 10)},
+					{result: loginResult(1326, 10)},
+					{result: loginResult(1327, 10)},
 				},
 			},
 		}
@@ -79,13 +86,13 @@ func TestClient(t *testing.T) {
 
 		waitForProcess()
 
-		want := client.Client{
+		want := &client.Client{
 			GameType:  5888,
 			UserID:    1325,
 			HallID:    10,
 			SessionID: types.SessionID("21d9b36e42c8275a4359f6815b859df05ec2bb0a"),
 		}
-		got := *spyHub.GetClient(0)
+		got := spyHub.GetClient(0)
 
 		assertClientEqual(t, want, got)
 	})
@@ -192,7 +199,7 @@ func TestHandleClientException(t *testing.T) {
 		defer player.Close()
 	})
 
-	t.Run("not response when send incorrect ws data", func(t *testing.T) {
+	t.Run("returns error when send incorrect ws data", func(t *testing.T) {
 		spyAPI := &SpyAPI{}
 		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
 		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
@@ -204,10 +211,12 @@ func TestHandleClientException(t *testing.T) {
 		})
 
 		writeBinaryMsg(t, player, `ola ola ola`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1000,"action":"","message":"invalid JSON","retryable":false}}`)
+		})
 	})
 
-	t.Run("not response when send incorrect ws action", func(t *testing.T) {
+	t.Run("returns error when send incorrect ws action", func(t *testing.T) {
 		spyAPI := &SpyAPI{}
 		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
 		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
@@ -219,7 +228,9 @@ func TestHandleClientException(t *testing.T) {
 		})
 
 		writeBinaryMsg(t, player, `{"action": "hello"}`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1001,"action":"hello","message":"unknown action","retryable":false}}`)
+		})
 	})
 
 	t.Run("call leaveMachine when client disconnect", func(t *testing.T) {
@@ -285,6 +296,315 @@ func TestHandleClientException(t *testing.T) {
 	})
 }
 
+func TestClientLimit(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	t.Run("refuse login and close when pool is full", func(t *testing.T) {
+		spyAPI := &SpyAPI{queue: map[string][]apiResponse{
+			"loginCheck": {
+				{result: loginResult(100, 6)},
+				{result: loginResult(101, 6)},
+			},
+		}}
+		pool := gode.NewClientHub()
+		pool.SetMaxClients(1)
+		server := httptest.NewServer(gode.NewServer(pool, spyAPI))
+		defer server.Close()
+
+		player1 := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player1.Close()
+		writeBinaryMsg(t, player1, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		waitForNumberOfClient(t, pool, 1)
+
+		player2 := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player2.Close()
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player2, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player2, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player2, `{"action":"onLoginRefused","result":{"reason":"client pool full, reach limit 1"}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertCloseCode(t, player2, websocket.CloseTryAgainLater)
+		})
+		waitForProcess()
+
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+		for _, l := range spyAPI.History() {
+			if l.function == "machineLeave" {
+				t.Errorf("refused client shouldn't leave machine, got %v", l)
+			}
+		}
+	})
+}
+
+func TestDuplicateLogin(t *testing.T) {
+	const timeout = time.Second
+	const loginMsg = `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`
+
+	t.Run("kick the older connection by default", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}}
+		pool := gode.NewClientHub()
+		server := httptest.NewServer(gode.NewServer(pool, spyAPI))
+		defer server.Close()
+
+		oldPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer oldPlayer.Close()
+		oldMessages := readMessages(oldPlayer)
+		assertReceiveWithin(t, timeout, oldMessages, `{"action":"ready","result":null}`)
+		writeBinaryMsg(t, oldPlayer, loginMsg)
+		assertReceiveWithin(t, timeout, oldMessages, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		assertReceiveWithin(t, timeout, oldMessages, `{"action":"onTakeMachine","result":null}`)
+
+		newPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer newPlayer.Close()
+		writeBinaryMsg(t, newPlayer, loginMsg)
+
+		assertReceiveWithin(t, timeout, oldMessages, `{"action":"onLoggedInElsewhere","result":null}`)
+		assertCloseCodeWithin(t, timeout, oldMessages, websocket.ClosePolicyViolation)
+		waitForHistory(t, spyAPI, 6)
+		waitForProcess()
+
+		uid := types.UserID(100)
+		hid := types.HallID(6)
+		gameCode := types.GameCode(0)
+		sid := types.SessionID(`21d9b36e42c8275a4359f6815b859df05ec2bb0a`)
+		gameType := types.GameType(5145)
+		expectedHistory := apiHistory{
+			{service: gameType, function: "loginCheck", parameters: []interface{}{sid}},
+			{service: gameType, function: "machineOccupy", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "loginCheck", parameters: []interface{}{sid}},
+			{service: gameType, function: "balanceExchange", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "machineLeave", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "machineOccupy", parameters: []interface{}{uid, hid, gameCode}},
+		}
+		assertLogEqual(t, expectedHistory, spyAPI.History())
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+		if len(spyAPI.History()) != len(expectedHistory) {
+			t.Errorf("kicked client should leave only once, got history %v", spyAPI.History())
+		}
+	})
+
+	t.Run("reject the new login when policy is reject new", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}}
+		pool := gode.NewClientHub()
+		svr := gode.NewServer(pool, spyAPI)
+		svr.SetGameTypeDuplicateLoginPolicy(5145, gode.RejectNew)
+		server := httptest.NewServer(svr)
+		defer server.Close()
+
+		oldPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer oldPlayer.Close()
+		oldMessages := readMessages(oldPlayer)
+		writeBinaryMsg(t, oldPlayer, loginMsg)
+		// ready, onLogin and onTakeMachine
+		for i := 0; i < 3; i++ {
+			receiveWithin(t, timeout, oldMessages)
+		}
+
+		newPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer newPlayer.Close()
+		newMessages := readMessages(newPlayer)
+		assertReceiveWithin(t, timeout, newMessages, `{"action":"ready","result":null}`)
+		writeBinaryMsg(t, newPlayer, loginMsg)
+		assertReceiveWithin(t, timeout, newMessages, `{"action":"onLoginRefused","result":{"reason":"user 100 already logged in"}}`)
+		assertCloseCodeWithin(t, timeout, newMessages, websocket.ClosePolicyViolation)
+		waitForProcess()
+
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+		for _, l := range spyAPI.History() {
+			if l.function == "machineLeave" {
+				t.Errorf("no one should leave machine, got %v", l)
+			}
+		}
+	})
+}
+
+func TestSessionState(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	t.Run("reject actions before login", func(t *testing.T) {
+		spyAPI := &SpyAPI{}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"beginGame4","sid":"123","betInfo":{"BetLevel":5}}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1002,"action":"beginGame4","message":"action not allowed in current state","retryable":false}}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"creditExchange","sid":"123","rate":"1:1","credit":"50000"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1002,"action":"creditExchange","message":"action not allowed in current state","retryable":false}}`)
+		})
+
+		if len(spyAPI.History()) != 0 {
+			t.Errorf("shouldn't call casino api, got %v", spyAPI.History())
+		}
+	})
+
+	t.Run("reject login twice on the same connection", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1002,"action":"loginBySid","message":"action not allowed in current state","retryable":false}}`)
+		})
+	})
+
+	t.Run("reject beginGame4 while the previous one in flight", func(t *testing.T) {
+		blockingAPI := &BlockingAPI{
+			SpyAPI:   &SpyAPI{response: map[string]apiResponse{"loginCheck": {result: loginResult(100, 6)}}},
+			function: "beginGame",
+			canceled: make(chan error, 1),
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), blockingAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+		messages := readMessages(player)
+
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"ready","result":null}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"onTakeMachine","result":null}`)
+
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":1}}`)
+		waitForHistory(t, blockingAPI.SpyAPI, 3)
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":1}}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"onError","result":{"code":1003,"action":"beginGame4","message":"action in flight","retryable":true}}`)
+
+		if len(blockingAPI.History()) != 3 {
+			t.Errorf("want beginGame called once, got %v", blockingAPI.History())
+		}
+	})
+
+	t.Run("not leave machine when disconnect before login", func(t *testing.T) {
+		spyAPI := &SpyAPI{}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		player.Close()
+		waitForProcess()
+
+		if len(spyAPI.History()) != 0 {
+			t.Errorf("shouldn't call casino api, got %v", spyAPI.History())
+		}
+	})
+
+	t.Run("close and leave machine when machineOccupy failed", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck":    {result: loginResult(100, 6)},
+			"machineOccupy": {err: context.DeadlineExceeded},
+		}}
+		pool := gode.NewClientHub()
+		server := httptest.NewServer(gode.NewServer(pool, spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+		messages := readMessages(player)
+
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"ready","result":null}`)
+		assertReceiveWithin(t, time.Second, messages, `{"action":"onError","result":{"code":2000,"action":"loginBySid","message":"casino api call failed","retryable":true}}`)
+		assertCloseCodeWithin(t, time.Second, messages, websocket.CloseTryAgainLater)
+		waitForNumberOfClient(t, pool, 0)
+
+		uid := types.UserID(100)
+		hid := types.HallID(6)
+		gameCode := types.GameCode(0)
+		gameType := types.GameType(5145)
+		assertLogEqual(t, apiHistory{
+			{service: gameType, function: "balanceExchange", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "machineLeave", parameters: []interface{}{uid, hid, gameCode}},
+		}, spyAPI.History()[2:])
+	})
+}
+
+func TestGameRegistry(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	registry, err := games.NewRegistry(
+		games.Game{GameType: 5145, Service: "casino.slot.line243.BuBuGaoSheng", Enabled: true, Actions: []string{"loginBySid", "beginGame4"}},
+		games.Game{GameType: 5156, Service: "casino.slot.crash.ZumaEmpire", Enabled: false},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/casino/5156", "/casino/5188"} {
+		t.Run(path+" returns 404 when game not enabled or not exists", func(t *testing.T) {
+			server := gode.NewServer(gode.NewClientHub(), &SpyAPI{})
+			server.SetGameRegistry(registry)
+
+			request, _ := http.NewRequest(http.MethodGet, path, nil)
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			assertResponseCode(t, recorder.Code, http.StatusNotFound)
+		})
+	}
+
+	t.Run("reject actions not supported by the game", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}}
+		svr := gode.NewServer(gode.NewClientHub(), spyAPI)
+		svr.SetGameRegistry(registry)
+		server := httptest.NewServer(svr)
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"creditExchange","sid":"123","rate":"1:1","credit":"50000"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1004,"action":"creditExchange","message":"action not supported by the game","retryable":false}}`)
+		})
+	})
+}
+
 func TestGameHandler(t *testing.T) {
 	const timeout = 10 * time.Millisecond
 	gameType := types.GameType(5199)
@@ -408,10 +728,290 @@ func TestGameHandler(t *testing.T) {
 	})
 }
 
+func TestReplayCasinoAPI(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	records, err := casinoapi.ReadRecords(strings.NewReader(`
+{"gameType":5145,"function":"loginCheck","parameters":["21d9b36e42c8275a4359f6815b859df05ec2bb0a"],"response":"{\"event\":true,\"data\":{\"user\":{\"UserID\":\"100\",\"HallID\":\"6\"},\"session\":{\"session\":\"21d9b36e42c8275a4359f6815b859df05ec2bb0a\"}}}"}
+{"gameType":5145,"function":"machineOccupy","parameters":["100","6","0"],"response":"{\"event\":true}"}
+{"gameType":5145,"function":"beginGame","parameters":["21d9b36e42c8275a4359f6815b859df05ec2bb0a","0","{\"BetLevel\":5}"],"response":"{\"event\":true,\"data\":{\"WagersID\":\"5566\"}}"}
+{"gameType":5145,"function":"beginGame","parameters":["21d9b36e42c8275a4359f6815b859df05ec2bb0a","0","{\"BetLevel\":5}"],"businessError":{"function":"beginGame","code":"1234","message":"credit not enough"}}
+`))
+	if err != nil {
+		t.Fatalf("could not read records, %v", err)
+	}
+	server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), casinoapi.NewReplay(records...)))
+	defer server.Close()
+	player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+	defer player.Close()
+
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"session":{"session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":{"event":true}}`)
+
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":5}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onBeginGame","result":{"event":true,"data":{"WagersID":"5566"}}}`)
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":5}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2003,"action":"beginGame4","message":"code 1234: credit not enough","retryable":false}}`)
+	})
+}
+
+func TestCacheCasinoAPI(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	spyAPI := &SpyAPI{response: map[string]apiResponse{
+		"loginCheck": {result: loginResult(100, 6)},
+		"onLoadInfo": {result: []byte(`{"event":true}`)},
+		"beginGame":  {result: []byte(`{"event":true}`)},
+	}}
+	caller := casinoapi.Chain(spyAPI, casinoapi.WithCache(casinoapi.DefaultCachePolicy))
+	server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), caller))
+	defer server.Close()
+	player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+	defer player.Close()
+
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+
+		for _, action := range []string{"onLoadInfo2", "onLoadInfo2", "beginGame4", "onLoadInfo2"} {
+			writeBinaryMsg(t, player, fmt.Sprintf(`{"action":%q,"betInfo":{"BetLevel":5}}`, action))
+			_, _, err := player.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessageError %v", err)
+			}
+		}
+	})
+
+	var onLoadInfoCalls int
+	for _, l := range spyAPI.History() {
+		if l.function == "onLoadInfo" {
+			onLoadInfoCalls++
+		}
+	}
+	if onLoadInfoCalls != 2 {
+		t.Errorf("want onLoadInfo cached until beginGame, called 2 times, got %d", onLoadInfoCalls)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	spyAPI := &SpyAPI{response: map[string]apiResponse{
+		"loginCheck": {result: loginResult(100, 6)},
+		"beginGame":  {result: []byte(`{"event":true}`)},
+	}}
+	gameServer := gode.NewServer(gode.NewClientHub(), spyAPI)
+	gameServer.SetRateLimits(map[string]gode.RateLimit{client.BeginGame: {Rate: 1, Burst: 2}})
+	server := httptest.NewServer(gameServer)
+	defer server.Close()
+	player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+	defer player.Close()
+
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+
+		for i := 0; i < 2; i++ {
+			writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":5}}`)
+			assertReceiveBinaryMsg(t, player, `{"action":"onBeginGame","result":{"event":true}}`)
+		}
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":5}}`)
+		assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1005,"action":"beginGame4","message":"action sent too fast","retryable":true}}`)
+	})
+
+	var beginGameCalls int
+	for _, l := range spyAPI.History() {
+		if l.function == "beginGame" {
+			beginGameCalls++
+		}
+	}
+	if beginGameCalls != 2 {
+		t.Errorf("want beginGame called 2 times, got %d", beginGameCalls)
+	}
+	if throttled := gameServer.Throttled()[client.BeginGame]; throttled != 1 {
+		t.Errorf("want 1 throttled, got %d", throttled)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	const timeout = time.Second
+	spyAPI := &SpyAPI{response: map[string]apiResponse{
+		"loginCheck": {result: loginResult(100, 6)},
+		"beginGame":  {result: []byte(`{"event":true}`)},
+	}}
+	registry := metrics.NewRegistry()
+	gameServer := gode.NewServer(gode.NewClientHub(), spyAPI)
+	gameServer.SetMetrics(registry)
+	server := httptest.NewServer(gameServer)
+	defer server.Close()
+	player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+	})
+	writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+	})
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+	})
+	writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":5}}`)
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"onBeginGame","result":{"event":true}}`)
+	})
+	writeBinaryMsg(t, player, `{"action":"hello"}`)
+	assertWithin(t, timeout, func() {
+		assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":1001,"action":"hello","message":"unknown action","retryable":false}}`)
+	})
+	assertMetrics(t, registry,
+		`gode_clients{game_type="5145",hall_id="6"} 1`,
+		`gode_ws_messages_in_total{action="beginGame4"} 1`,
+		`gode_ws_messages_in_total{action="loginBySid"} 1`,
+		`gode_ws_messages_in_total{action="unknown"} 1`,
+		`gode_ws_messages_out_total{action="onError"} 1`,
+		`gode_ws_messages_out_total{action="onLogin"} 1`,
+		`gode_ws_messages_out_total{action="ready"} 1`,
+	)
+
+	player.Close()
+	assertMetrics(t, registry, `gode_disconnects_total{reason="peer closed"} 1`)
+
+	t.Run("count login failures by error code", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{"loginCheck": {result: []byte(`{"event":false}`)}}}
+		registry := metrics.NewRegistry()
+		gameServer := gode.NewServer(gode.NewClientHub(), spyAPI)
+		gameServer.SetMetrics(registry)
+		server := httptest.NewServer(gameServer)
+		defer server.Close()
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+
+		assertMetrics(t, registry, `gode_login_failures_total{code="2001"} 1`)
+	})
+}
+
+// assertMetrics wait a second at most for every line in metrics
+func assertMetrics(t *testing.T, registry *metrics.Registry, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		recorder := httptest.NewRecorder()
+		registry.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		var missing []string
+		for _, line := range want {
+			if !strings.Contains(recorder.Body.String(), line+"\n") {
+				missing = append(missing, line)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("want %s in metrics\n%s", strings.Join(missing, ", "), recorder.Body)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCancelCasinoAPI(t *testing.T) {
+	t.Run("cancel in flight call and leave machine when client disconnect", func(t *testing.T) {
+		blockingAPI := &BlockingAPI{
+			SpyAPI:   &SpyAPI{response: map[string]apiResponse{"loginCheck": {result: loginResult(100, 6)}}},
+			function: "beginGame",
+			canceled: make(chan error, 1),
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), blockingAPI))
+		defer server.Close()
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		waitForProcess()
+		writeBinaryMsg(t, player, `{"action":"beginGame4","betInfo":{"BetLevel":1}}`)
+		waitForProcess()
+		player.Close()
+
+		select {
+		case err := <-blockingAPI.canceled:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("want error %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected in flight call canceled after client disconnect")
+		}
+		waitForProcess()
+		assertCalled(t, blockingAPI.SpyAPI, "machineLeave")
+	})
+
+	t.Run("settle kicked client after its in flight call canceled", func(t *testing.T) {
+		const loginMsg = `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`
+		blockingAPI := &BlockingAPI{
+			SpyAPI:   &SpyAPI{response: map[string]apiResponse{"loginCheck": {result: loginResult(100, 6)}}},
+			function: "beginGame",
+			// unbuffered, the canceled call stays in flight until received
+			canceled: make(chan error),
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), blockingAPI))
+		defer server.Close()
+
+		oldPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer oldPlayer.Close()
+		writeBinaryMsg(t, oldPlayer, loginMsg)
+		writeBinaryMsg(t, oldPlayer, `{"action":"beginGame4","betInfo":{"BetLevel":1}}`)
+		waitForHistory(t, blockingAPI.SpyAPI, 3)
+
+		newPlayer := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer newPlayer.Close()
+		writeBinaryMsg(t, newPlayer, loginMsg)
+		waitForHistory(t, blockingAPI.SpyAPI, 4)
+
+		time.Sleep(50 * time.Millisecond)
+		for _, l := range blockingAPI.History() {
+			if l.function == "balanceExchange" || l.function == "machineLeave" {
+				t.Fatalf("settled before beginGame finished, got %v", l)
+			}
+		}
+
+		select {
+		case err := <-blockingAPI.canceled:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("want error %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected in flight call of the kicked client canceled")
+		}
+		waitForHistory(t, blockingAPI.SpyAPI, 7)
+
+		uid := types.UserID(100)
+		hid := types.HallID(6)
+		gameCode := types.GameCode(0)
+		sid := types.SessionID(`21d9b36e42c8275a4359f6815b859df05ec2bb0a`)
+		gameType := types.GameType(5145)
+		expectedHistory := apiHistory{
+			{service: gameType, function: "loginCheck", parameters: []interface{}{sid}},
+			{service: gameType, function: "machineOccupy", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "beginGame", parameters: []interface{}{sid, gameCode, types.BetInfo(`{"BetLevel":1}`)}},
+			{service: gameType, function: "loginCheck", parameters: []interface{}{sid}},
+			{service: gameType, function: "balanceExchange", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "machineLeave", parameters: []interface{}{uid, hid, gameCode}},
+			{service: gameType, function: "machineOccupy", parameters: []interface{}{uid, hid, gameCode}},
+		}
+		assertLogEqual(t, expectedHistory, blockingAPI.History())
+	})
+}
+
 func TestHandleCasinoAPIException(t *testing.T) {
-	const timeout = 10 * time.Millisecond
+	// generous for a login exchange under -race on a busy machine, passing tests don't wait for it
+	const timeout = 100 * time.Millisecond
 
-	t.Run("disconnect when loginCheck return invalid result", func(t *testing.T) {
+	t.Run("returns error when loginCheck return invalid result", func(t *testing.T) {
 		spyAPI := &SpyAPI{
 			response: map[string]apiResponse{
 				"loginCheck": {
@@ -430,10 +1030,89 @@ func TestHandleCasinoAPIException(t *testing.T) {
 		})
 
 		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2001,"action":"loginBySid","message":"login failed","retryable":false}}`)
+		})
+	})
+
+	t.Run("returns login failed when loginCheck refused", func(t *testing.T) {
+		spyAPI := &SpyAPI{
+			response: map[string]apiResponse{
+				"loginCheck": {
+					result: nil,
+					err:    &casinoapi.BusinessError{Function: "loginCheck", Code: "44", Message: "session expired"},
+				},
+			},
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2001,"action":"loginBySid","message":"code 44: session expired","retryable":false}}`)
+		})
+	})
+
+	t.Run("returns refused error when beginGame refused", func(t *testing.T) {
+		spyAPI := &SpyAPI{
+			response: map[string]apiResponse{
+				"loginCheck": {
+					result: loginResult(100, 6),
+				},
+				"beginGame": {
+					result: nil,
+					err:    &casinoapi.BusinessError{Function: "beginGame", Code: "1234", Message: "credit not enough"},
+				},
+			},
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"beginGame4","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a","betInfo":{"BetLevel":5}}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2003,"action":"beginGame4","message":"code 1234: credit not enough","retryable":false}}`)
+		})
+	})
+
+	t.Run("returns retryable error when middleware fails the call", func(t *testing.T) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{"loginCheck": {result: loginResult(100, 6)}}}
+		caller := casinoapi.Chain(spyAPI, casinoapi.WithFaults(casinoapi.Faults{ErrorRate: 1}))
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), caller))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2000,"action":"loginBySid","message":"casino api call failed","retryable":true}}`)
+		})
+		if history := spyAPI.History(); len(history) != 0 {
+			t.Errorf("want casino api not called, got %v", history)
+		}
 	})
 
-	t.Run("disconnect when loginCheck error", func(t *testing.T) {
+	t.Run("returns retryable error when loginCheck error", func(t *testing.T) {
 		spyAPI := &SpyAPI{
 			response: map[string]apiResponse{
 				"loginCheck": {
@@ -452,12 +1131,18 @@ func TestHandleCasinoAPIException(t *testing.T) {
 		})
 
 		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2000,"action":"loginBySid","message":"casino api call failed","retryable":true}}`)
+		})
 	})
 
-	t.Run("disconnect when machineOccupy error", func(t *testing.T) {
+	t.Run("returns retryable error when machineOccupy error", func(t *testing.T) {
 		spyAPI := &SpyAPI{
 			response: map[string]apiResponse{
+				"loginCheck": {
+					result: loginResult(100, 6),
+					err:    nil,
+				},
 				"machineOccupy": {
 					result: []byte(``),
 					err:    fmt.Errorf("some api error"),
@@ -474,12 +1159,18 @@ func TestHandleCasinoAPIException(t *testing.T) {
 		})
 
 		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2000,"action":"loginBySid","message":"casino api call failed","retryable":true}}`)
+		})
 	})
 
-	t.Run("disconnect when beginGame error", func(t *testing.T) {
+	t.Run("returns not retryable error when beginGame error", func(t *testing.T) {
 		spyAPI := &SpyAPI{
 			response: map[string]apiResponse{
+				"loginCheck": {
+					result: loginResult(100, 6),
+					err:    nil,
+				},
 				"beginGame": {
 					result: []byte(``),
 					err:    fmt.Errorf("some api error"),
@@ -494,8 +1185,74 @@ func TestHandleCasinoAPIException(t *testing.T) {
 		assertWithin(t, timeout, func() {
 			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
 		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+		})
 
 		writeBinaryMsg(t, player, `{"action":"beginGame4","sid":"123","betInfo":{"BetLevel":5}}`)
-		assertNoResponseWithin(t, timeout, player)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2000,"action":"beginGame4","message":"casino api call failed","retryable":false}}`)
+		})
+	})
+
+	t.Run("returns retryable error when onLoadInfo error", func(t *testing.T) {
+		spyAPI := &SpyAPI{
+			response: map[string]apiResponse{
+				"loginCheck": {
+					result: loginResult(100, 6),
+					err:    nil,
+				},
+				"onLoadInfo": {
+					result: []byte(``),
+					err:    fmt.Errorf("some api error"),
+				},
+			},
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onLogin","result":{"event":true,"data":{"user":{"UserID":"100","HallID":"6"},"Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}}`)
+		})
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onTakeMachine","result":null}`)
+		})
+
+		writeBinaryMsg(t, player, `{"action":"onLoadInfo2","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2000,"action":"onLoadInfo2","message":"casino api call failed","retryable":true}}`)
+		})
+	})
+	t.Run("returns game unavailable error when circuit open", func(t *testing.T) {
+		spyAPI := &SpyAPI{
+			response: map[string]apiResponse{
+				"loginCheck": {
+					result: nil,
+					err:    &casinoapi.CircuitOpenError{GameType: 5145, RetryAfter: 30 * time.Second},
+				},
+			},
+		}
+		server := httptest.NewServer(gode.NewServer(gode.NewClientHub(), spyAPI))
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer server.Close()
+		defer player.Close()
+
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"ready","result":null}`)
+		})
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		assertWithin(t, timeout, func() {
+			assertReceiveBinaryMsg(t, player, `{"action":"onError","result":{"code":2002,"action":"loginBySid","message":"game unavailable","retryable":false}}`)
+		})
 	})
 }
@@ -0,0 +1,142 @@
+package gode
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode/client"
+	"gode/log"
+	"gode/types"
+)
+
+// ClientInfo is what admin api shows about a connected client
+type ClientInfo struct {
+	UserID       types.UserID   `json:"userID"`
+	HallID       types.HallID   `json:"hallID"`
+	GameType     types.GameType `json:"gameType"`
+	State        string         `json:"state"`
+	RemoteAddr   string         `json:"remoteAddr"`
+	ConnectedAt  time.Time      `json:"connectedAt"`
+	LastAction   string         `json:"lastAction"`
+	LastActionAt time.Time      `json:"lastActionAt"`
+}
+
+func newClientInfo(c *client.Client) ClientInfo {
+	lastAction, lastActionAt := c.LastAction()
+
+	return ClientInfo{
+		UserID:       c.UserID,
+		HallID:       c.HallID,
+		GameType:     c.GameType,
+		State:        c.State().String(),
+		RemoteAddr:   c.RemoteAddr,
+		ConnectedAt:  c.ConnectedAt,
+		LastAction:   lastAction,
+		LastActionAt: lastActionAt,
+	}
+}
+
+// AdminHandler returns the handler of admin api, should be served on a separate listener.
+// every request must carry header "Authorization: Bearer {token}", empty token rejects all.
+//
+//	GET    /clients[?hallID=10][&gameType=5145]  list connected clients
+//	GET    /clients/{userID}                     fetch one client
+//	DELETE /clients/{userID}                     force disconnect, settle credit and leave machine
+func (s *Server) AdminHandler(token string) http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/clients", s.listClientsHandler)
+	router.HandleFunc("/clients/", s.clientHandler)
+
+	return requireToken(token, router)
+}
+
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listClientsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	clients := s.clients.Clients()
+	if hallID := r.URL.Query().Get("hallID"); hallID != "" {
+		id, err := strconv.ParseUint(hallID, 10, 16)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clients = s.clients.ClientsByHallID(types.HallID(id))
+	}
+
+	var gameTypeFilter types.GameType
+	if gameType := r.URL.Query().Get("gameType"); gameType != "" {
+		gt, err := strconv.ParseUint(gameType, 10, 16)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gameTypeFilter = types.GameType(gt)
+	}
+
+	infos := make([]ClientInfo, 0, len(clients))
+	for _, c := range clients {
+		if gameTypeFilter != 0 && c.GameType != gameTypeFilter {
+			continue
+		}
+		infos = append(infos, newClientInfo(c))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].UserID < infos[j].UserID
+	})
+
+	writeJSON(w, infos)
+}
+
+func (s *Server) clientHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/clients/"), 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	c, ok := s.clients.ClientByUserID(types.UserID(userID))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, newClientInfo(c))
+	case http.MethodDelete:
+		s.disconnect(context.Background(), c, client.KickedResponse, websocket.ClosePolicyViolation, "kicked by admin")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Print(log.Notice, fmt.Sprintf("admin writeJSON error: %v", err))
+	}
+}
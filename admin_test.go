@@ -0,0 +1,124 @@
+package gode_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode"
+)
+
+func TestAdminHandler(t *testing.T) {
+	const token = "secret"
+	const timeout = time.Second
+
+	spyAPI := &SpyAPI{queue: map[string][]apiResponse{
+		"loginCheck": {
+			{result: loginResult(100, 6)},
+			{result: loginResult(101, 7)},
+		},
+	}}
+	pool := gode.NewClientHub()
+	svr := gode.NewServer(pool, spyAPI)
+	server := httptest.NewServer(svr)
+	defer server.Close()
+	admin := svr.AdminHandler(token)
+
+	// login one by one, so users got the loginCheck results in order
+	login := func(path string) (*websocket.Conn, <-chan wsMessage) {
+		player := mustDialWS(t, makeWebSocketURL(server, path))
+		messages := readMessages(player)
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		// ready, onLogin, onTakeMachine
+		for i := 0; i < 3; i++ {
+			receiveWithin(t, timeout, messages)
+		}
+
+		return player, messages
+	}
+	player1, player1Messages := login("/casino/5145")
+	defer player1.Close()
+	player2, _ := login("/casino/5156")
+	defer player2.Close()
+
+	adminRequest := func(method, path, token string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, nil)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, request)
+
+		return recorder
+	}
+
+	t.Run("returns 401 without valid token", func(t *testing.T) {
+		assertResponseCode(t, adminRequest(http.MethodGet, "/clients", "").Code, http.StatusUnauthorized)
+		assertResponseCode(t, adminRequest(http.MethodGet, "/clients", "wrong").Code, http.StatusUnauthorized)
+		assertResponseCode(t, adminRequest(http.MethodDelete, "/clients/100", "wrong").Code, http.StatusUnauthorized)
+	})
+
+	t.Run("list connected clients", func(t *testing.T) {
+		recorder := adminRequest(http.MethodGet, "/clients", token)
+		assertResponseCode(t, recorder.Code, http.StatusOK)
+
+		var infos []gode.ClientInfo
+		if err := json.NewDecoder(recorder.Body).Decode(&infos); err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 2 {
+			t.Fatalf("want 2 clients, got %+v", infos)
+		}
+		got := infos[0]
+		if got.UserID != 100 || got.HallID != 6 || got.GameType != 5145 || got.State != "machine occupied" ||
+			got.LastAction != "loginBySid" || got.RemoteAddr == "" || got.ConnectedAt.IsZero() {
+			t.Errorf("client info not correct, got %+v", got)
+		}
+	})
+
+	t.Run("filter clients by hall id and game type", func(t *testing.T) {
+		var infos []gode.ClientInfo
+		recorder := adminRequest(http.MethodGet, "/clients?hallID=7", token)
+		_ = json.NewDecoder(recorder.Body).Decode(&infos)
+		if len(infos) != 1 || infos[0].UserID != 101 {
+			t.Errorf("want user 101 in hall 7, got %+v", infos)
+		}
+
+		recorder = adminRequest(http.MethodGet, "/clients?gameType=5145", token)
+		_ = json.NewDecoder(recorder.Body).Decode(&infos)
+		if len(infos) != 1 || infos[0].UserID != 100 {
+			t.Errorf("want user 100 on game 5145, got %+v", infos)
+		}
+
+		assertResponseCode(t, adminRequest(http.MethodGet, "/clients?hallID=abc", token).Code, http.StatusBadRequest)
+	})
+
+	t.Run("fetch one client", func(t *testing.T) {
+		recorder := adminRequest(http.MethodGet, "/clients/101", token)
+		assertResponseCode(t, recorder.Code, http.StatusOK)
+
+		var info gode.ClientInfo
+		_ = json.NewDecoder(recorder.Body).Decode(&info)
+		if info.UserID != 101 || info.GameType != 5156 {
+			t.Errorf("want user 101, got %+v", info)
+		}
+
+		assertResponseCode(t, adminRequest(http.MethodGet, "/clients/9999", token).Code, http.StatusNotFound)
+	})
+
+	t.Run("force disconnect a user", func(t *testing.T) {
+		recorder := adminRequest(http.MethodDelete, "/clients/100", token)
+		assertResponseCode(t, recorder.Code, http.StatusNoContent)
+
+		assertReceiveWithin(t, timeout, player1Messages, `{"action":"onKicked","result":null}`)
+		assertCloseCodeWithin(t, timeout, player1Messages, websocket.ClosePolicyViolation)
+		waitForNumberOfClient(t, pool, 1)
+
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+		assertCalled(t, spyAPI, "machineLeave")
+		assertResponseCode(t, adminRequest(http.MethodDelete, "/clients/100", token).Code, http.StatusNotFound)
+	})
+}
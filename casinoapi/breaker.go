@@ -0,0 +1,141 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"gode/log"
+	"gode/types"
+)
+
+// BreakerPolicy decide when a circuit opens and how long it stays open
+type BreakerPolicy struct {
+	// consecutive failures to open the circuit, 0 or less disables the breaker
+	Threshold int
+	// calls fail fast while open, then one trial call decides close or open again
+	OpenTimeout time.Duration
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{
+	Threshold:   5,
+	OpenTimeout: 30 * time.Second,
+}
+
+// CircuitOpenError returned without calling flash2db when the circuit of the game is open
+type CircuitOpenError struct {
+	GameType types.GameType
+	// time left before the next trial call
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("game %d unavailable, retry after %v", e.GameType, e.RetryAfter)
+}
+
+// Breaker keep a circuit per game type, fail fast when a game service keeps failing.
+type Breaker struct {
+	next   Caller
+	policy BreakerPolicy
+
+	mutex    sync.Mutex
+	circuits map[types.GameType]*circuit
+
+	now func() time.Time
+}
+
+// circuit is closed when openedAt is zero
+type circuit struct {
+	failures int
+	openedAt time.Time
+	// a trial call in flight after open timeout
+	trial bool
+}
+
+func NewBreaker(next Caller, policy BreakerPolicy) *Breaker {
+	return &Breaker{
+		next:     next,
+		policy:   policy,
+		circuits: make(map[types.GameType]*circuit),
+		now:      time.Now,
+	}
+}
+
+func (b *Breaker) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	if b.policy.Threshold <= 0 {
+		return b.next.Call(ctx, gt, function, parameters...)
+	}
+
+	if err := b.allow(gt); err != nil {
+		return nil, err
+	}
+
+	result, err := b.next.Call(ctx, gt, function, parameters...)
+	b.record(gt, err)
+
+	return result, err
+}
+
+// allow returns CircuitOpenError when the circuit of game is open and not ready for a trial call
+func (b *Breaker) allow(gt types.GameType) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.circuits[gt]
+	if !ok || c.openedAt.IsZero() {
+		return nil
+	}
+
+	retryAfter := c.openedAt.Add(b.policy.OpenTimeout).Sub(b.now())
+	if retryAfter > 0 || c.trial {
+		if retryAfter < 0 {
+			retryAfter = 0
+		}
+		return &CircuitOpenError{GameType: gt, RetryAfter: retryAfter}
+	}
+	c.trial = true
+
+	return nil
+}
+
+func (b *Breaker) record(gt types.GameType, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := b.circuits[gt]
+	if !ok {
+		c = &circuit{}
+		b.circuits[gt] = c
+	}
+
+	// canceled by player disconnecting, says nothing about flash2db
+	if errors.Is(err, context.Canceled) {
+		c.trial = false
+		return
+	}
+
+	// flash2db responds event false, the service is working
+	var businessError *BusinessError
+	if errors.As(err, &businessError) {
+		err = nil
+	}
+
+	if err == nil {
+		if !c.openedAt.IsZero() {
+			log.PrintFields(log.Info, "circuit closed", "gameType", gt)
+		}
+		c.failures = 0
+		c.openedAt = time.Time{}
+		c.trial = false
+		return
+	}
+
+	c.failures++
+	if c.trial || (c.openedAt.IsZero() && c.failures >= b.policy.Threshold) {
+		log.PrintFields(log.Warning, "circuit opened", "gameType", gt, "failures", c.failures, "error", err)
+		c.openedAt = b.now()
+		c.trial = false
+	}
+}
@@ -0,0 +1,118 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker_Call(t *testing.T) {
+	policy := BreakerPolicy{Threshold: 2, OpenTimeout: time.Minute}
+	errFlash2db := errors.New("flash2db not got code 200")
+
+	newBreaker := func(stub *stubCaller) (*Breaker, *time.Time) {
+		now := time.Now()
+		b := NewBreaker(stub, policy)
+		b.now = func() time.Time { return now }
+		return b, &now
+	}
+
+	t.Run("open circuit after consecutive failures and fail fast", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db}}
+		b, _ := newBreaker(stub)
+
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+		_, err := b.Call(context.Background(), 5145, BeginGame)
+
+		var circuitOpen *CircuitOpenError
+		if !errors.As(err, &circuitOpen) || circuitOpen.GameType != 5145 || circuitOpen.RetryAfter != time.Minute {
+			t.Errorf("want CircuitOpenError of game 5145, got %v", err)
+		}
+		assertCalls(t, stub, 2)
+
+		// circuit of other games still closed
+		if _, err := b.Call(context.Background(), 5156, BeginGame); err != nil {
+			t.Errorf("didn't expect an error but got one, %v", err)
+		}
+	})
+
+	t.Run("success resets failures", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, nil, errFlash2db}}
+		b, _ := newBreaker(stub)
+
+		for i := 0; i < 4; i++ {
+			_, _ = b.Call(context.Background(), 5145, BeginGame)
+		}
+
+		assertCalls(t, stub, 4)
+	})
+
+	t.Run("not count canceled calls", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{context.Canceled, context.Canceled, context.Canceled}}
+		b, _ := newBreaker(stub)
+
+		for i := 0; i < 4; i++ {
+			_, _ = b.Call(context.Background(), 5145, BeginGame)
+		}
+
+		assertCalls(t, stub, 4)
+	})
+
+	t.Run("not count business errors", func(t *testing.T) {
+		refused := &BusinessError{Function: BeginGame}
+		stub := &stubCaller{errs: []error{refused, refused, refused}}
+		b, _ := newBreaker(stub)
+
+		for i := 0; i < 4; i++ {
+			_, _ = b.Call(context.Background(), 5145, BeginGame)
+		}
+
+		assertCalls(t, stub, 4)
+	})
+
+	t.Run("close circuit after trial call succeed", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db}}
+		b, now := newBreaker(stub)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+
+		*now = now.Add(time.Minute)
+		if _, err := b.Call(context.Background(), 5145, BeginGame); err != nil {
+			t.Errorf("want trial call succeed, got %v", err)
+		}
+		if _, err := b.Call(context.Background(), 5145, BeginGame); err != nil {
+			t.Errorf("want circuit closed, got %v", err)
+		}
+		assertCalls(t, stub, 4)
+	})
+
+	t.Run("open circuit again after trial call failed", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db, errFlash2db}}
+		b, now := newBreaker(stub)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+
+		*now = now.Add(time.Minute)
+		_, _ = b.Call(context.Background(), 5145, BeginGame)
+		_, err := b.Call(context.Background(), 5145, BeginGame)
+
+		var circuitOpen *CircuitOpenError
+		if !errors.As(err, &circuitOpen) {
+			t.Errorf("want CircuitOpenError, got %v", err)
+		}
+		assertCalls(t, stub, 3)
+	})
+
+	t.Run("never open when threshold not set", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db, errFlash2db}}
+		b := NewBreaker(stub, BreakerPolicy{})
+
+		for i := 0; i < 4; i++ {
+			_, _ = b.Call(context.Background(), 5145, BeginGame)
+		}
+
+		assertCalls(t, stub, 4)
+	})
+}
@@ -0,0 +1,183 @@
+package casinoapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gode/types"
+)
+
+// CachePolicy decide which functions cached and which ones invalidate the cache
+type CachePolicy struct {
+	// time to live of each cached function, functions not listed are not cached
+	TTLs map[string]time.Duration
+	// money-moving functions, cached results of the same user dropped after called
+	Invalidate []string
+}
+
+var DefaultCachePolicy = CachePolicy{
+	TTLs: map[string]time.Duration{
+		OnLoadInfo:       5 * time.Second,
+		GetMachineDetail: 5 * time.Second,
+	},
+	Invalidate: []string{BeginGame, CreditExchange, BalanceExchange},
+}
+
+// Cache returns the result of the same read only call within TTL.
+// only calls with user in ctx(see WithUser) cached, so they could be invalidated.
+type Cache struct {
+	next       Caller
+	ttls       map[string]time.Duration
+	invalidate map[string]bool
+
+	mutex   sync.Mutex
+	entries map[string]cacheEntry
+	// keys of entries cached for each user
+	byUser map[cacheUser]map[string]struct{}
+	// calls filling the cache in flight for each user
+	filling map[cacheUser]int
+	// increased every time the user invalidated while filling, results of calls began before not cached,
+	// removed when the user has no calls filling
+	generations map[cacheUser]uint64
+	lastSweep   time.Time
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	result    []byte
+	expiresAt time.Time
+	user      cacheUser
+}
+
+type cacheUser struct {
+	gameType types.GameType
+	userID   types.UserID
+}
+
+func NewCache(next Caller, policy CachePolicy) *Cache {
+	invalidate := make(map[string]bool)
+	for _, function := range policy.Invalidate {
+		invalidate[function] = true
+	}
+
+	return &Cache{
+		next:        next,
+		ttls:        policy.TTLs,
+		invalidate:  invalidate,
+		entries:     make(map[string]cacheEntry),
+		byUser:      make(map[cacheUser]map[string]struct{}),
+		filling:     make(map[cacheUser]int),
+		generations: make(map[cacheUser]uint64),
+		now:         time.Now,
+	}
+}
+
+func WithCache(policy CachePolicy) Middleware {
+	return func(next Caller) Caller {
+		return NewCache(next, policy)
+	}
+}
+
+func (c *Cache) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	userID, hasUser := UserFromContext(ctx)
+	user := cacheUser{gameType: gt, userID: userID}
+
+	if c.invalidate[function] {
+		result, err := c.next.Call(ctx, gt, function, parameters...)
+		// money may moved even when failed
+		if hasUser {
+			c.drop(user)
+		}
+		return result, err
+	}
+
+	ttl := c.ttls[function]
+	if ttl <= 0 || !hasUser {
+		return c.next.Call(ctx, gt, function, parameters...)
+	}
+
+	key := callKey(gt, function, stringify(parameters))
+	result, generation, ok := c.get(key, user)
+	if ok {
+		return result, nil
+	}
+
+	result, err := c.next.Call(ctx, gt, function, parameters...)
+	c.fill(key, user, generation, result, err, ttl)
+
+	return result, err
+}
+
+// get returns the cached result, or the generation of user when not cached,
+// fill must be called after the call when not cached.
+func (c *Cache) get(key string, user cacheUser) (result []byte, generation uint64, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !c.now().Before(entry.expiresAt) {
+		c.filling[user]++
+		return nil, c.generations[user], false
+	}
+
+	return entry.result, 0, true
+}
+
+// fill cache the result unless the call failed or user invalidated after generation
+func (c *Cache) fill(key string, user cacheUser, generation uint64, result []byte, err error, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	invalidated := c.generations[user] != generation
+	c.filling[user]--
+	if c.filling[user] == 0 {
+		delete(c.filling, user)
+		delete(c.generations, user)
+	}
+	if err != nil || invalidated {
+		return
+	}
+	now := c.now()
+	c.sweep(now)
+
+	c.entries[key] = cacheEntry{result: result, expiresAt: now.Add(ttl), user: user}
+	if c.byUser[user] == nil {
+		c.byUser[user] = make(map[string]struct{})
+	}
+	c.byUser[user][key] = struct{}{}
+}
+
+// drop all entries cached for user
+func (c *Cache) drop(user cacheUser) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key := range c.byUser[user] {
+		delete(c.entries, key)
+	}
+	delete(c.byUser, user)
+	if c.filling[user] > 0 {
+		c.generations[user]++
+	}
+}
+
+// sweep remove expired entries at most once a second, must be called with mutex locked
+func (c *Cache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Second {
+		return
+	}
+	c.lastSweep = now
+
+	for key, entry := range c.entries {
+		if now.Before(entry.expiresAt) {
+			continue
+		}
+		delete(c.entries, key)
+		delete(c.byUser[entry.user], key)
+		if len(c.byUser[entry.user]) == 0 {
+			delete(c.byUser, entry.user)
+		}
+	}
+}
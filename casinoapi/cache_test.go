@@ -0,0 +1,154 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+func TestCache_Call(t *testing.T) {
+	policy := CachePolicy{
+		TTLs:       map[string]time.Duration{OnLoadInfo: time.Second},
+		Invalidate: []string{BeginGame},
+	}
+	user100 := WithUser(context.Background(), 100)
+	user101 := WithUser(context.Background(), 101)
+
+	newCache := func(next Caller) (*Cache, *time.Time) {
+		now := time.Now()
+		c := NewCache(next, policy)
+		c.now = func() time.Time { return now }
+		return c, &now
+	}
+
+	t.Run("return cached result within TTL", func(t *testing.T) {
+		stub := &stubCaller{}
+		c, now := newCache(stub)
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		result, err := c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		if err != nil || string(result) != `{"event":true}` {
+			t.Errorf("want cached result, got %s %v", result, err)
+		}
+		assertCalls(t, stub, 1)
+
+		*now = now.Add(time.Second)
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		assertCalls(t, stub, 2)
+	})
+
+	t.Run("cache by game type, function and parameters", func(t *testing.T) {
+		stub := &stubCaller{}
+		c, _ := newCache(stub)
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(user100, 5156, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(1))
+		_, _ = c.Call(user100, 5145, GetMachineDetail, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(user100, 5145, GetMachineDetail, types.UserID(100), types.GameCode(0))
+
+		assertCalls(t, stub, 5)
+	})
+
+	t.Run("invalidate cache of the user after money-moving call", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{nil, nil, errors.New("flash2db not got code 200")}}
+		c, _ := newCache(stub)
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(user101, 5145, OnLoadInfo, types.UserID(101), types.GameCode(0))
+		// failed, but money may have moved
+		_, _ = c.Call(user100, 5145, BeginGame, types.SessionID("sid"), types.GameCode(0), types.BetInfo(`{}`))
+		assertCalls(t, stub, 3)
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		assertCalls(t, stub, 4)
+		_, _ = c.Call(user101, 5145, OnLoadInfo, types.UserID(101), types.GameCode(0))
+		assertCalls(t, stub, 4)
+	})
+
+	t.Run("not cache calls without user", func(t *testing.T) {
+		stub := &stubCaller{}
+		c, _ := newCache(stub)
+
+		_, _ = c.Call(context.Background(), 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(context.Background(), 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+
+		assertCalls(t, stub, 2)
+	})
+
+	t.Run("not cache errors", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errors.New("flash2db not got code 200")}}
+		c, _ := newCache(stub)
+
+		_, err := c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		if err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+		_, err = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		if err != nil {
+			t.Errorf("didn't expect an error but got one, %v", err)
+		}
+		assertCalls(t, stub, 2)
+	})
+
+	t.Run("not cache result of call began before invalidated", func(t *testing.T) {
+		stub := &stubCaller{}
+		reading := make(chan struct{})
+		invalidated := make(chan struct{})
+		var c *Cache
+		c, _ = newCache(CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+			if function == OnLoadInfo && stub.Calls() == 0 {
+				close(reading)
+				<-invalidated
+			}
+			return stub.Call(ctx, gt, function, parameters...)
+		}))
+
+		done := make(chan struct{})
+		go func() {
+			_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+			close(done)
+		}()
+		<-reading
+		_, _ = c.Call(user100, 5145, BeginGame, types.SessionID("sid"), types.GameCode(0), types.BetInfo(`{}`))
+		close(invalidated)
+		<-done
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		assertCalls(t, stub, 3)
+	})
+
+	t.Run("forget users without cached results", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{nil, errors.New("flash2db not got code 200")}}
+		c, now := newCache(stub)
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(user101, 5145, OnLoadInfo, types.UserID(101), types.GameCode(0))
+		_, _ = c.Call(user100, 5145, BeginGame, types.SessionID("sid"), types.GameCode(0), types.BetInfo(`{}`))
+		_, _ = c.Call(user101, 5145, BeginGame, types.SessionID("sid"), types.GameCode(0), types.BetInfo(`{}`))
+		if len(c.byUser) != 0 || len(c.filling) != 0 || len(c.generations) != 0 {
+			t.Errorf("want no user kept after invalidated, got %d cached %d filling %d generations", len(c.byUser), len(c.filling), len(c.generations))
+		}
+
+		_, _ = c.Call(user100, 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		*now = now.Add(2 * time.Second)
+		_, _ = c.Call(user101, 5145, OnLoadInfo, types.UserID(101), types.GameCode(0))
+		if _, ok := c.byUser[cacheUser{gameType: 5145, userID: 100}]; ok {
+			t.Errorf("want user with expired results swept, got %v", c.byUser)
+		}
+	})
+}
+
+func TestWithUser(t *testing.T) {
+	if _, ok := UserFromContext(context.Background()); ok {
+		t.Errorf("want no user in background context")
+	}
+
+	userID, ok := UserFromContext(WithUser(context.Background(), 9527))
+	if !ok || userID != 9527 {
+		t.Errorf("want user 9527, got %d %v", userID, ok)
+	}
+}
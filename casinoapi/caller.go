@@ -1,7 +1,35 @@
 package casinoapi
 
-import "gode/types"
+import (
+	"context"
 
+	"gode/types"
+)
+
+// Caller call casino api, the call should be canceled when ctx done
 type Caller interface {
-	Call(service types.GameType, function string, parameters ...interface{}) ([]byte, error)
+	Call(ctx context.Context, service types.GameType, function string, parameters ...interface{}) ([]byte, error)
+}
+
+// CallerFunc is an adapter to use an ordinary function as a Caller
+type CallerFunc func(ctx context.Context, service types.GameType, function string, parameters ...interface{}) ([]byte, error)
+
+func (f CallerFunc) Call(ctx context.Context, service types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	return f(ctx, service, function, parameters...)
+}
+
+// Middleware decorate a Caller with a cross-cutting concern, e.g. logging or retry
+type Middleware func(next Caller) Caller
+
+// Chain wrap caller with middlewares, the first middleware is the outermost, so
+//
+//	Chain(flash2db, WithBreaker(b), WithRetry(r))
+//
+// calls breaker, then retry, then flash2db.
+func Chain(caller Caller, middlewares ...Middleware) Caller {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		caller = middlewares[i](caller)
+	}
+
+	return caller
 }
@@ -0,0 +1,126 @@
+package casinoapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gode/types"
+)
+
+// Coalesce merge concurrent identical calls of read only functions into one call to next,
+// every caller gets the same result. the merged call is canceled only when all callers gave up.
+type Coalesce struct {
+	next      Caller
+	functions map[string]bool
+
+	mutex sync.Mutex
+	calls map[string]*inflightCall
+	// calls not sent to next by function
+	saved map[string]uint64
+}
+
+type inflightCall struct {
+	done    chan struct{}
+	result  []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewCoalesce merge calls of functions, e.g. SafeFunctions, money-moving functions must not be listed.
+func NewCoalesce(next Caller, functions []string) *Coalesce {
+	m := make(map[string]bool)
+	for _, function := range functions {
+		m[function] = true
+	}
+
+	return &Coalesce{
+		next:      next,
+		functions: m,
+		calls:     make(map[string]*inflightCall),
+		saved:     make(map[string]uint64),
+	}
+}
+
+func WithCoalesce(functions []string) Middleware {
+	return func(next Caller) Caller {
+		return NewCoalesce(next, functions)
+	}
+}
+
+func (c *Coalesce) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	if !c.functions[function] {
+		return c.next.Call(ctx, gt, function, parameters...)
+	}
+
+	key := callKey(gt, function, stringify(parameters))
+
+	c.mutex.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.saved[function]++
+		c.mutex.Unlock()
+		return c.wait(ctx, key, call)
+	}
+
+	callCtx, cancel := context.WithCancel(detachedContext{ctx})
+	call := &inflightCall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+	c.calls[key] = call
+	c.mutex.Unlock()
+
+	go func() {
+		call.result, call.err = c.next.Call(callCtx, gt, function, parameters...)
+		cancel()
+
+		c.mutex.Lock()
+		if c.calls[key] == call {
+			delete(c.calls, key)
+		}
+		c.mutex.Unlock()
+		close(call.done)
+	}()
+
+	return c.wait(ctx, key, call)
+}
+
+func (c *Coalesce) wait(ctx context.Context, key string, call *inflightCall) ([]byte, error) {
+	select {
+	case <-call.done:
+		return call.result, call.err
+	case <-ctx.Done():
+		c.mutex.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			call.cancel()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+		}
+		c.mutex.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Saved returns the number of calls merged into another one by function
+func (c *Coalesce) Saved() map[string]uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	saved := make(map[string]uint64, len(c.saved))
+	for function, n := range c.saved {
+		saved[function] = n
+	}
+
+	return saved
+}
+
+// detachedContext keep the values of the parent but not canceled with it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+func (c detachedContext) Value(key interface{}) interface{}     { return c.parent.Value(key) }
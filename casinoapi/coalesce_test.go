@@ -0,0 +1,150 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+// blockingCaller blocks every call until released or ctx done
+type blockingCaller struct {
+	stubCaller
+	release  chan struct{}
+	started  chan struct{}
+	canceled chan error
+}
+
+func newBlockingCaller() *blockingCaller {
+	return &blockingCaller{
+		release:  make(chan struct{}),
+		started:  make(chan struct{}, 100),
+		canceled: make(chan error, 100),
+	}
+}
+
+func (b *blockingCaller) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return b.stubCaller.Call(ctx, gt, function, parameters...)
+	case <-ctx.Done():
+		b.canceled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+func TestCoalesce_Call(t *testing.T) {
+	t.Run("merge concurrent identical calls", func(t *testing.T) {
+		const callers = 10
+		next := newBlockingCaller()
+		c := NewCoalesce(next, SafeFunctions)
+
+		wg := sync.WaitGroup{}
+		results := make(chan string, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := c.Call(context.Background(), 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+				if err != nil {
+					t.Errorf("didn't expect an error but got one, %v", err)
+				}
+				results <- string(result)
+			}()
+		}
+		<-next.started
+		waitFor(t, func() bool { return c.Saved()[OnLoadInfo] == callers-1 })
+		close(next.release)
+		wg.Wait()
+		close(results)
+
+		for result := range results {
+			if result != `{"event":true}` {
+				t.Errorf("want every caller got the result, got %s", result)
+			}
+		}
+		assertCalls(t, &next.stubCaller, 1)
+		if saved := c.Saved()[OnLoadInfo]; saved != callers-1 {
+			t.Errorf("want %d calls saved, got %d", callers-1, saved)
+		}
+	})
+
+	t.Run("not merge calls of different parameters or functions not listed", func(t *testing.T) {
+		next := newBlockingCaller()
+		close(next.release)
+		c := NewCoalesce(next, SafeFunctions)
+
+		_, _ = c.Call(context.Background(), 5145, OnLoadInfo, types.UserID(100), types.GameCode(0))
+		_, _ = c.Call(context.Background(), 5145, OnLoadInfo, types.UserID(101), types.GameCode(0))
+		_, _ = c.Call(context.Background(), 5145, BeginGame, types.SessionID("sid"))
+
+		assertCalls(t, &next.stubCaller, 3)
+		if saved := c.Saved(); len(saved) != 0 {
+			t.Errorf("want no calls saved, got %v", saved)
+		}
+	})
+
+	t.Run("keep calling when one of the callers canceled", func(t *testing.T) {
+		next := newBlockingCaller()
+		c := NewCoalesce(next, SafeFunctions)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		canceled := make(chan error)
+		go func() {
+			_, err := c.Call(ctx, 5145, GetMachineDetail, types.UserID(100))
+			canceled <- err
+		}()
+		<-next.started
+		done := make(chan error)
+		go func() {
+			_, err := c.Call(context.Background(), 5145, GetMachineDetail, types.UserID(100))
+			done <- err
+		}()
+		waitFor(t, func() bool { return c.Saved()[GetMachineDetail] == 1 })
+
+		cancel()
+		if err := <-canceled; !errors.Is(err, context.Canceled) {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+		close(next.release)
+		if err := <-done; err != nil {
+			t.Errorf("didn't expect an error but got one, %v", err)
+		}
+	})
+
+	t.Run("cancel the call when all callers canceled", func(t *testing.T) {
+		next := newBlockingCaller()
+		c := NewCoalesce(next, SafeFunctions)
+		ctx, cancel := context.WithCancel(WithUser(context.Background(), 100))
+
+		go func() {
+			_, _ = c.Call(ctx, 5145, GetMachineDetail, types.UserID(100))
+		}()
+		<-next.started
+		cancel()
+
+		select {
+		case err := <-next.canceled:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("want error %v, got %v", context.Canceled, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected call canceled")
+		}
+	})
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
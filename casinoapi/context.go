@@ -0,0 +1,53 @@
+package casinoapi
+
+import (
+	"context"
+
+	"gode/types"
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	hallKey
+	sessionKey
+)
+
+// WithUser returns a copy of ctx carrying the user the call made for,
+// middlewares use it when the user is not in the parameters, e.g. beginGame.
+func WithUser(ctx context.Context, userID types.UserID) context.Context {
+	return context.WithValue(ctx, userKey, userID)
+}
+
+// UserFromContext returns the user set by WithUser
+func UserFromContext(ctx context.Context) (types.UserID, bool) {
+	userID, ok := ctx.Value(userKey).(types.UserID)
+
+	return userID, ok
+}
+
+// WithHall returns a copy of ctx carrying the hall of the user, Routes use it to pick the flash2db cluster.
+func WithHall(ctx context.Context, hallID types.HallID) context.Context {
+	return context.WithValue(ctx, hallKey, hallID)
+}
+
+// HallFromContext returns the hall set by WithHall
+func HallFromContext(ctx context.Context) (types.HallID, bool) {
+	hallID, ok := ctx.Value(hallKey).(types.HallID)
+
+	return hallID, ok
+}
+
+// WithSession returns a copy of ctx carrying the session of a call made before the user known, e.g. loginCheck,
+// Upstreams pin the session then the user to the same node.
+func WithSession(ctx context.Context, sessionID types.SessionID) context.Context {
+	return context.WithValue(ctx, sessionKey, sessionID)
+}
+
+// SessionFromContext returns the session set by WithSession, false when empty
+func SessionFromContext(ctx context.Context) (types.SessionID, bool) {
+	sessionID, ok := ctx.Value(sessionKey).(types.SessionID)
+
+	return sessionID, ok && len(sessionID) > 0
+}
@@ -1,11 +1,17 @@
 package casinoapi
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
+	"gode/games"
 	"gode/log"
 	"gode/types"
 )
@@ -13,55 +19,169 @@ import (
 const PathPrefix = "/amfphp/json.php"
 
 const ServiceClient = "Client"
-const Service5145 = "casino.slot.line243.BuBuGaoSheng"
-const Service5156 = "casino.slot.crash.ZumaEmpire"
+
+// FormParameters is the form key of parameters in order, decoded as an array by php
+const FormParameters = "parameters[]"
+
+// DefaultTimeout applied when timeout of the function not set in registry
+const DefaultTimeout = 10 * time.Second
 
 type Flash2db struct {
-	url string
+	upstreams *Upstreams
+	// nil means every game on upstreams
+	routes *Routes
+
+	registry *games.Registry
+
+	client *http.Client
+}
+
+// NewFlash2db returns a caller of the games in registry, other game types fail except loginCheck.
+func NewFlash2db(url string, registry *games.Registry) *Flash2db {
+	return &Flash2db{
+		upstreams: NewUpstreams([]string{url}, RoundRobin),
+		registry:  registry,
+		client:    &http.Client{},
+	}
+}
+
+// SetUpstreams set the flash2db nodes of games without their own upstream, should be called before any Call.
+func (f *Flash2db) SetUpstreams(upstreams *Upstreams) {
+	f.upstreams = upstreams
 }
 
-func NewFlash2db(url string) *Flash2db {
-	return &Flash2db{url: url}
+// SetRoutes set the clusters of game types and halls, should be called before any Call.
+func (f *Flash2db) SetRoutes(routes *Routes) {
+	f.routes = routes
 }
 
-func (f *Flash2db) Call(gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+func (f *Flash2db) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
 	service, err := f.getService(gt, function)
 	if err != nil {
 		return nil, err
 	}
-	url := f.url + f.makePath(service, function, parameters...)
-	response, err := http.Get(url)
+
+	ctx, cancel := context.WithTimeout(ctx, f.getTimeout(gt, function))
+	defer cancel()
+
+	baseURL, release, err := f.getURL(ctx, gt)
 	if err != nil {
-		msg := fmt.Sprintf("f2db get error: %v", err)
-		log.Print(log.Error, msg)
-		return nil, fmt.Errorf(msg)
+		return nil, err
 	}
+	defer release()
+
+	request, err := f.newRequest(ctx, baseURL, gt, service, function, parameters...)
+	if err != nil {
+		return nil, err
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		log.PrintFields(log.Error, "f2db get error", "url", request.URL.String(), "error", err)
+		return nil, fmt.Errorf("f2db get error: %w", err)
+	}
+	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("flash2db not got code 200")
 	}
-	defer response.Body.Close()
 	//todo: understand what this error means
 	content, _ := ioutil.ReadAll(response.Body)
 
-	log.Print(log.Debug, fmt.Sprintf("f2db url: %s", url))
-	log.Print(log.Debug, fmt.Sprintf("f2db res: %s", content))
+	log.PrintFields(log.Debug, "f2db response", "url", request.URL.String(), "response", string(content))
+
+	if err := CheckEvent(function, content); err != nil {
+		return nil, err
+	}
 
 	return content, nil
 }
 
+// newRequest send parameters in the url path, or in the POST body when transport of game is json or form
+func (f *Flash2db) newRequest(ctx context.Context, baseURL string, gt types.GameType, service, function string, parameters ...interface{}) (*http.Request, error) {
+	game, _ := f.registry.Game(gt)
+	switch game.Transport {
+	case games.TransportJSON:
+		body, err := json.Marshal(stringify(parameters))
+		if err != nil {
+			return nil, err
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+f.makePath(service, function), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		return request, nil
+
+	case games.TransportForm:
+		form := url.Values{FormParameters: stringify(parameters)}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+f.makePath(service, function), strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return request, nil
+
+	default:
+		// json.php drops empty segments, the parameters after it would shift
+		for i, value := range stringify(parameters) {
+			if value == "" {
+				return nil, fmt.Errorf("parameter %d of %s is empty, can not be sent in the url path", i, function)
+			}
+		}
+
+		return http.NewRequestWithContext(ctx, http.MethodGet, baseURL+f.makePath(service, function, parameters...), nil)
+	}
+}
+
+// stringify format parameters the same as in the url path
+func stringify(parameters []interface{}) []string {
+	values := make([]string, 0, len(parameters))
+	for _, p := range parameters {
+		values = append(values, fmt.Sprint(p))
+	}
+
+	return values
+}
+
 func (f *Flash2db) getService(gameType types.GameType, function string) (string, error) {
 	if function == LoginCheck {
 		return ServiceClient, nil
 	}
 
-	switch gameType {
-	case types.GameType(5145):
-		return Service5145, nil
-	case types.GameType(5156):
-		return Service5156, nil
+	game, ok := f.registry.Game(gameType)
+	if !ok {
+		return "", fmt.Errorf("game type %d not exists", gameType)
+	}
+	if !game.Enabled {
+		return "", fmt.Errorf("game type %d disabled", gameType)
+	}
+
+	return game.Service, nil
+}
+
+// getTimeout returns timeout of the function in registry, or DefaultTimeout
+func (f *Flash2db) getTimeout(gameType types.GameType, function string) time.Duration {
+	if timeout := f.registry.Timeout(gameType, function); timeout > 0 {
+		return timeout
 	}
 
-	return "", fmt.Errorf("game type not exsits")
+	return DefaultTimeout
+}
+
+// getURL returns a node of the cluster routed to, the upstream of the game, or a node of upstreams,
+// release must be called when the call done.
+func (f *Flash2db) getURL(ctx context.Context, gameType types.GameType) (string, func(), error) {
+	if f.routes != nil {
+		if upstreams := f.routes.resolve(ctx, gameType); upstreams != nil {
+			return upstreams.acquire(ctx)
+		}
+	}
+	if game, ok := f.registry.Game(gameType); ok && game.Upstream != "" {
+		return game.Upstream, func() {}, nil
+	}
+
+	return f.upstreams.acquire(ctx)
 }
 
 func (f *Flash2db) makePath(service, function string, parameters ...interface{}) string {
@@ -70,8 +190,20 @@ func (f *Flash2db) makePath(service, function string, parameters ...interface{})
 	b.WriteString(fmt.Sprintf("%s/%s.%s", PathPrefix, service, function))
 
 	for _, p := range parameters {
-		b.WriteString(fmt.Sprintf("/%v", p))
+		b.WriteString("/")
+		b.WriteString(escapeSegment(fmt.Sprint(p)))
 	}
 
 	return b.String()
 }
+
+// escapeSegment escape a parameter as one path segment, json.php split path by "/" then urldecode
+// every segment, so "/", "?", "#" and "+"(decoded as space) must be escaped too,
+// and "." or ".." escaped so they are not resolved as dot segments on the way.
+func escapeSegment(segment string) string {
+	if segment == "." || segment == ".." {
+		return strings.ReplaceAll(segment, ".", "%2E")
+	}
+
+	return strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+}
@@ -2,11 +2,19 @@ package casinoapi
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"gode/games"
 	"gode/types"
 )
 
@@ -25,8 +33,8 @@ func TestFlash2db_Call(t *testing.T) {
 			_, _ = fmt.Fprint(w, APIResult)
 		}))
 
-		f := NewFlash2db(server.URL)
-		gotResult, _ := f.Call(dummyGameType, function)
+		f := newTestFlash2db(t, server.URL)
+		gotResult, _ := f.Call(context.Background(), dummyGameType, function)
 
 		if bytes.Compare([]byte(APIResult), gotResult) != 0 {
 			t.Errorf("want %s, got %s", APIResult, gotResult)
@@ -46,8 +54,8 @@ func TestFlash2db_Call(t *testing.T) {
 			_, _ = fmt.Fprint(w, APIResult)
 		}))
 
-		f := NewFlash2db(server.URL)
-		gotResult, _ := f.Call(gt, function)
+		f := newTestFlash2db(t, server.URL)
+		gotResult, _ := f.Call(context.Background(), gt, function)
 
 		if bytes.Compare([]byte(APIResult), gotResult) != 0 {
 			t.Errorf("want %s, got %s", APIResult, gotResult)
@@ -72,8 +80,8 @@ func TestFlash2db_Call(t *testing.T) {
 			_, _ = fmt.Fprint(w, APIResult)
 		}))
 
-		f := NewFlash2db(server.URL)
-		gotResult, _ := f.Call(gt, function, sid, uid, betInfo, credit)
+		f := newTestFlash2db(t, server.URL)
+		gotResult, _ := f.Call(context.Background(), gt, function, sid, uid, betInfo, credit)
 
 		if bytes.Compare([]byte(APIResult), gotResult) != 0 {
 			t.Errorf("want %s, got %s", APIResult, gotResult)
@@ -83,17 +91,104 @@ func TestFlash2db_Call(t *testing.T) {
 	t.Run("returns error when game type not exists", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
 
-		f := NewFlash2db(server.URL)
-		_, err := f.Call(9999, dummyFunction)
+		f := newTestFlash2db(t, server.URL)
+		_, err := f.Call(context.Background(), 9999, dummyFunction)
 
 		if err == nil {
 			t.Errorf("expected an error but not got one")
 		}
 	})
 
+	t.Run("returns error when game type disabled", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("shouldn't call flash2db")
+		}))
+
+		f := newTestFlash2db(t, server.URL)
+		_, err := f.Call(context.Background(), 5188, "beginGame")
+
+		if err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+
+	t.Run("call the upstream of game when set", func(t *testing.T) {
+		called := false
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("shouldn't call the default flash2db")
+		}))
+
+		f := NewFlash2db(server.URL, mustNewRegistry(t, games.Game{GameType: 5145, Service: "casino.slot.line243.BuBuGaoSheng", Enabled: true, Upstream: upstream.URL}))
+		_, err := f.Call(context.Background(), 5145, "beginGame")
+
+		if err != nil {
+			t.Errorf("didn't expect an error but got one, %v", err)
+		}
+		if !called {
+			t.Errorf("expected upstream of game called")
+		}
+	})
+
+	t.Run("returns BusinessError when event false", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprint(w, `{"event":false,"data":{"code":"1234","message":"credit not enough"}}`)
+		}))
+		defer server.Close()
+
+		f := newTestFlash2db(t, server.URL)
+		result, err := f.Call(context.Background(), 5145, "beginGame")
+
+		want := &BusinessError{Function: "beginGame", Code: "1234", Message: "credit not enough"}
+		if !reflect.DeepEqual(err, want) {
+			t.Errorf("want error %v, got %v", want, err)
+		}
+		if result != nil {
+			t.Errorf("want no result, got %s", result)
+		}
+	})
+
+	t.Run("returns error when function timeout", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		f := NewFlash2db(server.URL, mustNewRegistry(t, games.Game{
+			GameType: 5145,
+			Service:  "casino.slot.line243.BuBuGaoSheng",
+			Enabled:  true,
+			Timeouts: games.Timeouts{"beginGame": games.Duration(10 * time.Millisecond)},
+		}))
+		_, err := f.Call(context.Background(), 5145, "beginGame")
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want error %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+
+	t.Run("returns error when context canceled", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		f := newTestFlash2db(t, server.URL)
+		_, err := f.Call(ctx, 5145, "beginGame")
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+	})
+
 	t.Run("returns error when connect failed", func(t *testing.T) {
-		f := NewFlash2db("http://not.exists")
-		_, err := f.Call(dummyGameType, dummyFunction, "dummyParam")
+		f := newTestFlash2db(t, "http://not.exists")
+		_, err := f.Call(context.Background(), dummyGameType, dummyFunction, "dummyParam")
 
 		if err == nil {
 			t.Errorf("expected an error but not got one")
@@ -106,8 +201,8 @@ func TestFlash2db_Call(t *testing.T) {
 			w.Write([]byte(`1231345fg`))
 		}))
 
-		f := NewFlash2db(server.URL)
-		_, err := f.Call(dummyGameType, dummyFunction, "dummyParam")
+		f := newTestFlash2db(t, server.URL)
+		_, err := f.Call(context.Background(), dummyGameType, dummyFunction, "dummyParam")
 
 		if err == nil {
 			t.Errorf("expected an error but not got one")
@@ -120,8 +215,8 @@ func TestFlash2db_Call(t *testing.T) {
 			return
 		}))
 
-		f := NewFlash2db(server.URL)
-		_, err := f.Call(dummyGameType, dummyFunction, "dummyParam")
+		f := newTestFlash2db(t, server.URL)
+		_, err := f.Call(context.Background(), dummyGameType, dummyFunction, "dummyParam")
 
 		if err == nil {
 			t.Errorf("expected an error but not got one")
@@ -138,6 +233,198 @@ func TestMakePath(t *testing.T) {
 	assertPathEqual(t, got, want)
 }
 
+func TestMakePath_Escape(t *testing.T) {
+	testCases := map[string]struct {
+		parameter interface{}
+		want      string
+	}{
+		"JSON bet info":     {types.BetInfo(`{"BetLevel":5}`), "%7B%22BetLevel%22:5%7D"},
+		"JSON with space":   {types.BetInfo(`{"Lines": [1, 2]}`), "%7B%22Lines%22:%20%5B1%2C%202%5D%7D"},
+		"slash":             {"a/b", "a%2Fb"},
+		"question mark":     {"a?b=1", "a%3Fb=1"},
+		"hash":              {"a#b", "a%23b"},
+		"plus":              {"a+b", "a%2Bb"},
+		"percent":           {"100%", "100%25"},
+		"backslash":         {`a\b`, "a%5Cb"},
+		"dot segment":       {"..", "%2E%2E"},
+		"current segment":   {".", "%2E"},
+		"dots in segment":   {"127.0.0.1", "127.0.0.1"},
+		"unicode":           {"步步高升", "%E6%AD%A5%E6%AD%A5%E9%AB%98%E5%8D%87"},
+		"number":            {types.Credit(50000), "50000"},
+		"session id":        {types.SessionID("21d9b36e42c8275a"), "21d9b36e42c8275a"},
+		"already escaped":   {"%2F", "%252F"},
+		"control character": {"a\nb", "a%0Ab"},
+	}
+
+	f := &Flash2db{}
+	for name, c := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := f.makePath("Client", "CheckLogin", c.parameter)
+			want := "/amfphp/json.php/Client.CheckLogin/" + c.want
+
+			assertPathEqual(t, got, want)
+		})
+	}
+}
+
+func TestFlash2db_Call_Escape(t *testing.T) {
+	// decode like json.php, split path by "/" then urldecode every segment
+	parameters := []interface{}{
+		types.SessionID("19870604xi"),
+		types.BetInfo(`{"BetLevel":5,"Note":"a/b?c#d+e 步"}`),
+		"%2F",
+		"..",
+		types.Credit(50000),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(r.URL.EscapedPath(), "/")[4:]
+		if len(segments) != len(parameters) {
+			t.Fatalf("want %d parameters, got %d %q", len(parameters), len(segments), r.URL.EscapedPath())
+		}
+		for i, segment := range segments {
+			got, err := url.QueryUnescape(segment)
+			if want := fmt.Sprint(parameters[i]); err != nil || got != want {
+				t.Errorf("want parameter %q, got %q %v", want, got, err)
+			}
+		}
+	}))
+	defer server.Close()
+
+	f := newTestFlash2db(t, server.URL)
+	if _, err := f.Call(context.Background(), 5145, "beginGame", parameters...); err != nil {
+		t.Errorf("didn't expect an error but got one, %v", err)
+	}
+}
+
+func TestFlash2db_Call_Transport(t *testing.T) {
+	gt := types.GameType(5145)
+	service := "casino.slot.line243.BuBuGaoSheng"
+	sid := types.SessionID(`19870604xi`)
+	uid := types.UserID(9527)
+	betInfo := types.BetInfo(`{"BetLevel":5}`)
+	credit := types.Credit(50000)
+	wantPath := fmt.Sprintf("%s/%s.%s", PathPrefix, service, "beginGame")
+	wantParameters := []string{"19870604xi", "9527", `{"BetLevel":5}`, "50000"}
+	APIResult := `{"event": true}`
+
+	newFlash2db := func(url, transport string) *Flash2db {
+		f := NewFlash2db(url, mustNewRegistry(t, games.Game{GameType: gt, Service: service, Enabled: true, Transport: transport}))
+		return f
+	}
+
+	t.Run("get parameters in path by default", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				t.Errorf("want method %s, got %s", http.MethodGet, r.Method)
+			}
+			assertPathEqual(t, r.URL.Path, wantPath+"/19870604xi/9527/{\"BetLevel\":5}/50000")
+
+			_, _ = fmt.Fprint(w, APIResult)
+		}))
+		defer server.Close()
+
+		f := newFlash2db(server.URL, "")
+		gotResult, err := f.Call(context.Background(), gt, "beginGame", sid, uid, betInfo, credit)
+
+		assertResult(t, APIResult, gotResult, err)
+	})
+
+	t.Run("returns error when parameter empty in path", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("shouldn't call flash2db, got %s", r.URL.EscapedPath())
+		}))
+		defer server.Close()
+
+		f := newFlash2db(server.URL, "")
+		_, err := f.Call(context.Background(), gt, "beginGame", sid, uid, types.BetInfo(""), credit)
+
+		if err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+
+	t.Run("post parameters as JSON array", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("want method %s, got %s", http.MethodPost, r.Method)
+			}
+			if got := r.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("want content type application/json, got %q", got)
+			}
+			assertPathEqual(t, r.URL.Path, wantPath)
+
+			var got []string
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Fatalf("could not decode body, %v", err)
+			}
+			if !reflect.DeepEqual(got, wantParameters) {
+				t.Errorf("want parameters %q, got %q", wantParameters, got)
+			}
+
+			_, _ = fmt.Fprint(w, APIResult)
+		}))
+		defer server.Close()
+
+		f := newFlash2db(server.URL, games.TransportJSON)
+		gotResult, err := f.Call(context.Background(), gt, "beginGame", sid, uid, betInfo, credit)
+
+		assertResult(t, APIResult, gotResult, err)
+	})
+
+	t.Run("post parameters as form values", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("want method %s, got %s", http.MethodPost, r.Method)
+			}
+			assertPathEqual(t, r.URL.Path, wantPath)
+
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("could not parse form, %v", err)
+			}
+			if got := r.PostForm[FormParameters]; !reflect.DeepEqual(got, wantParameters) {
+				t.Errorf("want parameters %q, got %q", wantParameters, got)
+			}
+
+			_, _ = fmt.Fprint(w, APIResult)
+		}))
+		defer server.Close()
+
+		f := newFlash2db(server.URL, games.TransportForm)
+		gotResult, err := f.Call(context.Background(), gt, "beginGame", sid, uid, betInfo, credit)
+
+		assertResult(t, APIResult, gotResult, err)
+	})
+}
+
+func assertResult(t *testing.T, want string, got []byte, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	if want != string(got) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func newTestFlash2db(t *testing.T, url string) *Flash2db {
+	t.Helper()
+	return NewFlash2db(url, mustNewRegistry(t,
+		games.Game{GameType: 5145, Service: "casino.slot.line243.BuBuGaoSheng", Enabled: true},
+		games.Game{GameType: 5156, Service: "casino.slot.crash.ZumaEmpire", Enabled: true},
+		games.Game{GameType: 5188, Service: "casino.slot.disabled", Enabled: false},
+	))
+}
+
+func mustNewRegistry(t *testing.T, g ...games.Game) *games.Registry {
+	t.Helper()
+	registry, err := games.NewRegistry(g...)
+	if err != nil {
+		t.Fatalf("could not create registry, %v", err)
+	}
+
+	return registry
+}
+
 func assertPathEqual(t *testing.T, got string, want string) {
 	t.Helper()
 	if got != want {
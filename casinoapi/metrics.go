@@ -0,0 +1,61 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gode/metrics"
+	"gode/types"
+)
+
+// Metrics observe the latency and count the errors of calls by function,
+// innermost in the chain to measure every call to flash2db, retries included.
+type Metrics struct {
+	next Caller
+
+	latency *metrics.Histogram
+	errors  *metrics.Counter
+}
+
+func NewMetrics(next Caller, registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		next:    next,
+		latency: registry.NewHistogram("gode_flash2db_call_duration_seconds", "Latency of flash2db calls by function.", metrics.DefaultBuckets, "function"),
+		errors:  registry.NewCounter("gode_flash2db_errors_total", "Failed flash2db calls by function and error.", "function", "error"),
+	}
+}
+
+func WithMetrics(registry *metrics.Registry) Middleware {
+	return func(next Caller) Caller {
+		return NewMetrics(next, registry)
+	}
+}
+
+func (m *Metrics) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	start := time.Now()
+	result, err := m.next.Call(ctx, gt, function, parameters...)
+	m.latency.Observe(time.Since(start).Seconds(), function)
+	if err != nil {
+		m.errors.Inc(function, errorKind(err))
+	}
+
+	return result, err
+}
+
+// errorKind keep label values bounded
+func errorKind(err error) string {
+	var businessError *BusinessError
+	switch {
+	case errors.As(err, &businessError):
+		return "refused"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrNoHealthyUpstream):
+		return "no_upstream"
+	}
+
+	return "failed"
+}
@@ -0,0 +1,40 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"gode/metrics"
+)
+
+func TestWithMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	stub := &stubCaller{errs: []error{
+		nil,
+		&BusinessError{Function: BeginGame},
+		context.DeadlineExceeded,
+		errors.New("f2db get error"),
+	}}
+	caller := Chain(stub, WithMetrics(registry))
+
+	for i := 0; i < 4; i++ {
+		_, _ = caller.Call(context.Background(), 5145, BeginGame)
+	}
+
+	b := strings.Builder{}
+	if err := registry.Write(&b); err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	for _, want := range []string{
+		`gode_flash2db_call_duration_seconds_count{function="beginGame"} 4`,
+		`gode_flash2db_errors_total{function="beginGame",error="failed"} 1`,
+		`gode_flash2db_errors_total{function="beginGame",error="refused"} 1`,
+		`gode_flash2db_errors_total{function="beginGame",error="timeout"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("want %s in\n%s", want, b.String())
+		}
+	}
+}
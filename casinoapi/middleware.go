@@ -0,0 +1,75 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"gode/log"
+	"gode/types"
+)
+
+func WithRetry(policy RetryPolicy) Middleware {
+	return func(next Caller) Caller {
+		return NewRetry(next, policy)
+	}
+}
+
+func WithBreaker(policy BreakerPolicy) Middleware {
+	return func(next Caller) Caller {
+		return NewBreaker(next, policy)
+	}
+}
+
+// WithLogging log every call with its latency, failed calls logged as notice
+func WithLogging() Middleware {
+	return func(next Caller) Caller {
+		return CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+			start := time.Now()
+			result, err := next.Call(ctx, gt, function, parameters...)
+			latency := time.Since(start)
+
+			if err != nil {
+				log.PrintFields(log.Notice, "casino api failed", "function", function, "gameType", gt, "latency", latency, "error", err)
+			} else {
+				log.PrintFields(log.Debug, "casino api done", "function", function, "gameType", gt, "latency", latency)
+			}
+
+			return result, err
+		})
+	}
+}
+
+// Faults injected by WithFaults, for testing how players affected when flash2db misbehaves
+type Faults struct {
+	// delay before every call
+	Latency time.Duration
+	// probability a call fails without calling next, 0 to 1
+	ErrorRate float64
+}
+
+// ErrFaultInjected returned by calls failed by WithFaults
+var ErrFaultInjected = errors.New("fault injected")
+
+// WithFaults delay calls and fail some of them, should not be used in production
+func WithFaults(faults Faults) Middleware {
+	return func(next Caller) Caller {
+		return CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+			if faults.Latency > 0 {
+				timer := time.NewTimer(faults.Latency)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil, ctx.Err()
+				case <-timer.C:
+				}
+			}
+			if faults.ErrorRate > 0 && rand.Float64() < faults.ErrorRate {
+				return nil, ErrFaultInjected
+			}
+
+			return next.Call(ctx, gt, function, parameters...)
+		})
+	}
+}
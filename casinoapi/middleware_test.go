@@ -0,0 +1,85 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	record := func(name string) Middleware {
+		return func(next Caller) Caller {
+			return CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+				order = append(order, name)
+				return next.Call(ctx, gt, function, parameters...)
+			})
+		}
+	}
+	caller := CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+		order = append(order, "caller")
+		return []byte(`{"event":true}`), nil
+	})
+
+	result, err := Chain(caller, record("first"), record("second")).Call(context.Background(), 5145, BeginGame)
+
+	if err != nil || string(result) != `{"event":true}` {
+		t.Errorf("want result of caller, got %s %v", result, err)
+	}
+	want := []string{"first", "second", "caller"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("want call order %v, got %v", want, order)
+	}
+
+	if got := Chain(caller); got == nil {
+		t.Errorf("want caller itself without middlewares")
+	}
+}
+
+func TestWithFaults(t *testing.T) {
+	t.Run("fail every call when error rate is 1", func(t *testing.T) {
+		stub := &stubCaller{}
+		caller := Chain(stub, WithFaults(Faults{ErrorRate: 1}))
+
+		_, err := caller.Call(context.Background(), 5145, BeginGame)
+
+		if err != ErrFaultInjected {
+			t.Errorf("want error %v, got %v", ErrFaultInjected, err)
+		}
+		assertCalls(t, stub, 0)
+	})
+
+	t.Run("delay calls", func(t *testing.T) {
+		stub := &stubCaller{}
+		caller := Chain(stub, WithFaults(Faults{Latency: 20 * time.Millisecond}))
+
+		start := time.Now()
+		_, err := caller.Call(context.Background(), 5145, BeginGame)
+
+		if err != nil {
+			t.Errorf("didn't expect an error but got one, %v", err)
+		}
+		if latency := time.Since(start); latency < 20*time.Millisecond {
+			t.Errorf("want latency at least 20ms, got %v", latency)
+		}
+		assertCalls(t, stub, 1)
+	})
+
+	t.Run("stop delay when context canceled", func(t *testing.T) {
+		stub := &stubCaller{}
+		caller := Chain(stub, WithFaults(Faults{Latency: time.Minute}))
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		_, err := caller.Call(ctx, 5145, BeginGame)
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+		assertCalls(t, stub, 0)
+	})
+}
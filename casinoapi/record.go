@@ -0,0 +1,184 @@
+package casinoapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gode/log"
+	"gode/types"
+)
+
+// Record is a call written by Recorder as a line of NDJSON, e.g.
+//
+//	{"time":"2020-08-01T12:00:00Z","gameType":5145,"function":"beginGame","parameters":["sid","0","{\"BetLevel\":5}"],"response":"{\"event\":true}","latency":"35ms"}
+type Record struct {
+	Time       time.Time      `json:"time"`
+	GameType   types.GameType `json:"gameType"`
+	Function   string         `json:"function"`
+	Parameters []string       `json:"parameters"`
+	// response as is, may not be valid JSON
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// set when flash2db responds event false, replayed as a BusinessError
+	BusinessError *BusinessError `json:"businessError,omitempty"`
+	Latency       string         `json:"latency"`
+}
+
+// Recorder write every call and its result to w
+type Recorder struct {
+	next Caller
+
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewRecorder(next Caller, w io.Writer) *Recorder {
+	return &Recorder{
+		next:    next,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+func WithRecorder(w io.Writer) Middleware {
+	return func(next Caller) Caller {
+		return NewRecorder(next, w)
+	}
+}
+
+func (r *Recorder) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	start := time.Now()
+	result, err := r.next.Call(ctx, gt, function, parameters...)
+
+	record := &Record{
+		Time:       start,
+		GameType:   gt,
+		Function:   function,
+		Parameters: stringify(parameters),
+		Response:   string(result),
+		Latency:    time.Since(start).String(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+		var businessError *BusinessError
+		if errors.As(err, &businessError) {
+			record.BusinessError = businessError
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if encodeErr := r.encoder.Encode(record); encodeErr != nil {
+		log.Print(log.Error, fmt.Sprintf("record %s of game %d error: %v", function, gt, encodeErr))
+	}
+
+	return result, err
+}
+
+// NoRecordError returned by Replay when no more recorded call matches
+type NoRecordError struct {
+	GameType   types.GameType
+	Function   string
+	Parameters []string
+}
+
+func (e *NoRecordError) Error() string {
+	return fmt.Sprintf("no record of %s of game %d with parameters %q", e.Function, e.GameType, e.Parameters)
+}
+
+// Replay returns the recorded results of calls with the same game type, function and parameters,
+// in the order they were recorded.
+type Replay struct {
+	mutex   sync.Mutex
+	records map[string][]Record
+}
+
+func NewReplay(records ...Record) *Replay {
+	r := &Replay{records: make(map[string][]Record)}
+	for _, record := range records {
+		key := callKey(record.GameType, record.Function, record.Parameters)
+		r.records[key] = append(r.records[key], record)
+	}
+
+	return r
+}
+
+// ReadRecords read the NDJSON written by Recorder
+func ReadRecords(reader io.Reader) ([]Record, error) {
+	var records []Record
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		record := Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
+
+func LoadReplay(path string) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records, err := ReadRecords(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return NewReplay(records...), nil
+}
+
+func (r *Replay) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	values := stringify(parameters)
+	key := callKey(gt, function, values)
+
+	r.mutex.Lock()
+	records := r.records[key]
+	if len(records) == 0 {
+		r.mutex.Unlock()
+		return nil, &NoRecordError{GameType: gt, Function: function, Parameters: values}
+	}
+	record := records[0]
+	r.records[key] = records[1:]
+	r.mutex.Unlock()
+
+	switch {
+	case record.BusinessError != nil:
+		return nil, record.BusinessError
+	case record.Error != "":
+		return nil, errors.New(record.Error)
+	default:
+		return []byte(record.Response), nil
+	}
+}
+
+// callKey identify calls with the same game type, function and parameters
+func callKey(gt types.GameType, function string, parameters []string) string {
+	if parameters == nil {
+		parameters = []string{}
+	}
+	key, _ := json.Marshal([]interface{}{gt, function, parameters})
+
+	return string(key)
+}
@@ -0,0 +1,128 @@
+package casinoapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gode/types"
+)
+
+func TestRecorder_Call(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	refused := &BusinessError{Function: BeginGame, Code: "1234", Message: "credit not enough"}
+	errFlash2db := errors.New("flash2db not got code 200")
+	responses := map[string]struct {
+		result []byte
+		err    error
+	}{
+		LoginCheck:     {result: []byte(`{"event":true}`)},
+		BeginGame:      {err: refused},
+		CreditExchange: {err: errFlash2db},
+	}
+	caller := Chain(CallerFunc(func(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+		return responses[function].result, responses[function].err
+	}), WithRecorder(buffer))
+
+	sid := types.SessionID("19870604xi")
+	_, _ = caller.Call(context.Background(), 5145, LoginCheck, sid)
+	_, _ = caller.Call(context.Background(), 5145, BeginGame, sid, types.GameCode(0), types.BetInfo(`{"BetLevel":5}`))
+	_, _ = caller.Call(context.Background(), 5145, CreditExchange, sid, types.GameCode(0), "1:1", types.Credit(1000))
+
+	records, err := ReadRecords(buffer)
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("want 3 records, got %d", len(records))
+	}
+	if r := records[0]; r.GameType != 5145 || r.Function != LoginCheck || r.Response != `{"event":true}` || r.Latency == "" || r.Time.IsZero() {
+		t.Errorf("loginCheck not recorded correctly, got %+v", r)
+	}
+	if r := records[1]; !reflect.DeepEqual(r.Parameters, []string{"19870604xi", "0", `{"BetLevel":5}`}) || !reflect.DeepEqual(r.BusinessError, refused) {
+		t.Errorf("beginGame not recorded correctly, got %+v", r)
+	}
+	if r := records[2]; r.Error != errFlash2db.Error() || r.BusinessError != nil {
+		t.Errorf("creditExchange not recorded correctly, got %+v", r)
+	}
+
+	t.Run("replay the records", func(t *testing.T) {
+		replay := NewReplay(records...)
+
+		result, err := replay.Call(context.Background(), 5145, LoginCheck, sid)
+		if err != nil || string(result) != `{"event":true}` {
+			t.Errorf("want recorded result, got %s %v", result, err)
+		}
+		_, err = replay.Call(context.Background(), 5145, BeginGame, sid, types.GameCode(0), types.BetInfo(`{"BetLevel":5}`))
+		if !reflect.DeepEqual(err, refused) {
+			t.Errorf("want error %v, got %v", refused, err)
+		}
+		_, err = replay.Call(context.Background(), 5145, CreditExchange, sid, types.GameCode(0), "1:1", types.Credit(1000))
+		if err == nil || err.Error() != errFlash2db.Error() {
+			t.Errorf("want error %v, got %v", errFlash2db, err)
+		}
+	})
+}
+
+func TestReplay_Call(t *testing.T) {
+	records, err := ReadRecords(strings.NewReader(`{"gameType":5145,"function":"beginGame","parameters":["sid"],"response":"{\"n\":1}"}
+
+{"gameType":5145,"function":"beginGame","parameters":["sid"],"response":"{\"n\":2}"}
+{"gameType":5156,"function":"beginGame","parameters":["sid"],"response":"{\"n\":3}"}
+{"gameType":5145,"function":"onLoadInfo","parameters":null,"response":"{\"n\":4}"}
+`))
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+
+	t.Run("replay in recorded order", func(t *testing.T) {
+		replay := NewReplay(records...)
+
+		for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+			result, err := replay.Call(context.Background(), 5145, BeginGame, "sid")
+			if err != nil || string(result) != want {
+				t.Errorf("want %s, got %s %v", want, result, err)
+			}
+		}
+		result, err := replay.Call(context.Background(), 5145, OnLoadInfo)
+		if err != nil || string(result) != `{"n":4}` {
+			t.Errorf("want %s, got %s %v", `{"n":4}`, result, err)
+		}
+	})
+
+	t.Run("returns NoRecordError when nothing matches", func(t *testing.T) {
+		replay := NewReplay(records...)
+
+		for _, call := range []struct {
+			gameType   types.GameType
+			parameters []interface{}
+		}{
+			{5145, []interface{}{"other sid"}},
+			{5188, []interface{}{"sid"}},
+		} {
+			_, err := replay.Call(context.Background(), call.gameType, BeginGame, call.parameters...)
+			var noRecord *NoRecordError
+			if !errors.As(err, &noRecord) {
+				t.Errorf("want NoRecordError, got %v", err)
+			}
+		}
+
+		_, _ = replay.Call(context.Background(), 5156, BeginGame, "sid")
+		_, err := replay.Call(context.Background(), 5156, BeginGame, "sid")
+		var noRecord *NoRecordError
+		if !errors.As(err, &noRecord) {
+			t.Errorf("want NoRecordError after records used up, got %v", err)
+		}
+	})
+
+	t.Run("returns error when record invalid", func(t *testing.T) {
+		_, err := ReadRecords(strings.NewReader(`{"gameType":5145}
+oops`))
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("want error of line 2, got %v", err)
+		}
+	})
+}
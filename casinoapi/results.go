@@ -0,0 +1,175 @@
+package casinoapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gode/types"
+)
+
+// BusinessError returned when flash2db responds "event": false, e.g.
+//
+//	{"event":false,"data":{"code":"1234","message":"credit not enough"}}
+type BusinessError struct {
+	Function string `json:"function"`
+	// code and message from flash2db, may be empty
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *BusinessError) Error() string {
+	if e.Code == "" && e.Message == "" {
+		return fmt.Sprintf("%s failed", e.Function)
+	}
+
+	return fmt.Sprintf("%s failed, code %s: %s", e.Function, e.Code, e.Message)
+}
+
+// eventResult is the part every flash2db response shares,
+// Event is nil when the response has no "event" field.
+type eventResult struct {
+	Event *bool           `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type errorData struct {
+	Code    flexString `json:"code"`
+	Message flexString `json:"message"`
+}
+
+// flexString unmarshal from JSON string or number
+type flexString string
+
+func (s *flexString) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var str string
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+		*s = flexString(str)
+
+		return nil
+	}
+	*s = flexString(b)
+
+	return nil
+}
+
+// CheckEvent returns BusinessError only when result has an explicit "event": false,
+// results not in JSON or without event are left to the caller.
+func CheckEvent(function string, result []byte) error {
+	r := &eventResult{}
+	if err := json.Unmarshal(result, r); err != nil {
+		return nil
+	}
+	if r.Event == nil || *r.Event {
+		return nil
+	}
+
+	// data of failed response not always carry code and message
+	data := &errorData{}
+	_ = json.Unmarshal(r.Data, data)
+
+	return &BusinessError{
+		Function: function,
+		Code:     string(data.Code),
+		Message:  string(data.Message),
+	}
+}
+
+// Decode check event of result then unmarshal it into v, e.g. a *BeginGameResult.
+func Decode(function string, result []byte, v interface{}) error {
+	if err := CheckEvent(function, result); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(result, v)
+}
+
+type LoginCheckResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		Session struct {
+			Session  types.SessionID `json:"session"`
+			CreateAt string          `json:"create_at"`
+		} `json:"session"`
+		User struct {
+			UserID       types.UserID `json:"UserID"`
+			Username     string       `json:"Username"`
+			LoginName    string       `json:"LoginName"`
+			Currency     string       `json:"Currency"`
+			Cash         string       `json:"Cash"`
+			HallID       types.HallID `json:"HallID"`
+			ExchangeRate string       `json:"ExchangeRate"`
+			Test         string       `json:"Test"`
+		} `json:"user"`
+	} `json:"data"`
+}
+
+type MachineOccupyResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		MachineID string `json:"MachineID"`
+		Balance   string `json:"Balance"`
+	} `json:"data"`
+}
+
+type OnLoadInfoResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		Credit       string `json:"Credit"`
+		BetBase      string `json:"BetBase"`
+		Balance      string `json:"Balance"`
+		Currency     string `json:"Currency"`
+		ExchangeRate string `json:"ExchangeRate"`
+	} `json:"data"`
+}
+
+type GetMachineDetailResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		MachineID string `json:"MachineID"`
+		Credit    string `json:"Credit"`
+		BetBase   string `json:"BetBase"`
+	} `json:"data"`
+}
+
+type BeginGameResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		WagersID string `json:"WagersID"`
+		Credit   string `json:"Credit"`
+		BetTotal string `json:"BetTotal"`
+		PayTotal string `json:"PayTotal"`
+		// game specific outcome, e.g. lines and symbols of a slot
+		Result json.RawMessage `json:"Result"`
+	} `json:"data"`
+}
+
+type CreditExchangeResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		Credit  string `json:"Credit"`
+		BetBase string `json:"BetBase"`
+		Balance string `json:"Balance"`
+	} `json:"data"`
+}
+
+type BalanceExchangeResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		Amount  string `json:"Amount"`
+		Balance string `json:"Balance"`
+	} `json:"data"`
+}
+
+type MachineLeaveResult struct {
+	Event bool `json:"event"`
+	Data  struct {
+		MachineID string `json:"MachineID"`
+	} `json:"data"`
+}
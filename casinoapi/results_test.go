@@ -0,0 +1,82 @@
+package casinoapi
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckEvent(t *testing.T) {
+	testCases := map[string]struct {
+		result string
+		want   error
+	}{
+		"event true":           {`{"event":true,"data":{}}`, nil},
+		"without event":        {`{"testing":"beginGame"}`, nil},
+		"not JSON":             {`oops`, nil},
+		"event false":          {`{"event":false}`, &BusinessError{Function: BeginGame}},
+		"with string code":     {`{"event":false,"data":{"code":"1234","message":"credit not enough"}}`, &BusinessError{Function: BeginGame, Code: "1234", Message: "credit not enough"}},
+		"with number code":     {`{"event":false,"data":{"code":1234,"message":"credit not enough"}}`, &BusinessError{Function: BeginGame, Code: "1234", Message: "credit not enough"}},
+		"with array as data":   {`{"event":false,"data":[]}`, &BusinessError{Function: BeginGame}},
+		"with escaped message": {`{"event":false,"data":{"code":"1234","message":"say \"hi\"\n"}}`, &BusinessError{Function: BeginGame, Code: "1234", Message: "say \"hi\"\n"}},
+		"with unicode message": {`{"event":false,"data":{"code":"1234","message":"\u984d\u5ea6\u4e0d\u8db3"}}`, &BusinessError{Function: BeginGame, Code: "1234", Message: "額度不足"}},
+		"with null code":       {`{"event":false,"data":{"code":null,"message":null}}`, &BusinessError{Function: BeginGame}},
+	}
+
+	for name, c := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got := CheckEvent(BeginGame, []byte(c.result))
+
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("want %#v, got %#v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	t.Run("decode typed results", func(t *testing.T) {
+		beginGame := &BeginGameResult{}
+		err := Decode(BeginGame, []byte(`{"event":true,"data":{"WagersID":"5566","Credit":"1000","BetTotal":"50","PayTotal":"100","Result":{"Lines":[1]}}}`), beginGame)
+		if err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+		if beginGame.Data.WagersID != "5566" || beginGame.Data.PayTotal != "100" || string(beginGame.Data.Result) != `{"Lines":[1]}` {
+			t.Errorf("beginGame not decoded correctly, got %+v", beginGame.Data)
+		}
+
+		login := &LoginCheckResult{}
+		err = Decode(LoginCheck, []byte(`{"event":true,"data":{"user":{"UserID":"9527","HallID":"6"},"session":{"session":"abc"}}}`), login)
+		if err != nil || login.Data.User.UserID != 9527 || login.Data.User.HallID != 6 || login.Data.Session.Session.String() != "abc" {
+			t.Errorf("loginCheck not decoded correctly, got %+v %v", login.Data, err)
+		}
+
+		for function, result := range map[string]interface{}{
+			MachineOccupy:    &MachineOccupyResult{},
+			OnLoadInfo:       &OnLoadInfoResult{},
+			GetMachineDetail: &GetMachineDetailResult{},
+			CreditExchange:   &CreditExchangeResult{},
+			BalanceExchange:  &BalanceExchangeResult{},
+			MachineLeave:     &MachineLeaveResult{},
+		} {
+			if err := Decode(function, []byte(`{"event":true,"data":{"Credit":"1000"}}`), result); err != nil {
+				t.Errorf("%s didn't expect an error but got one, %v", function, err)
+			}
+		}
+	})
+
+	t.Run("returns BusinessError when event false", func(t *testing.T) {
+		err := Decode(CreditExchange, []byte(`{"event":false,"data":{"code":"99","message":"balance not enough"}}`), &CreditExchangeResult{})
+
+		var businessError *BusinessError
+		if !errors.As(err, &businessError) || businessError.Code != "99" {
+			t.Errorf("want BusinessError, got %v", err)
+		}
+	})
+
+	t.Run("returns error when not JSON", func(t *testing.T) {
+		if err := Decode(OnLoadInfo, []byte(`oops`), &OnLoadInfoResult{}); err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"gode/log"
+	"gode/types"
+)
+
+// SafeFunctions only read from flash2db, calling them again has no side effect
+var SafeFunctions = []string{LoginCheck, OnLoadInfo, GetMachineDetail}
+
+// RetryPolicy decide which functions retried and how long to wait between attempts
+type RetryPolicy struct {
+	// total attempts including the first call, 1 or less means never retry
+	Attempts int
+	// wait before the first retry, doubled every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// functions safe to call again, money-moving functions must not be listed unless idempotent
+	Functions []string
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   3,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: time.Second,
+	Functions:  SafeFunctions,
+}
+
+// Retry call again the functions in policy when failed, other functions called once.
+type Retry struct {
+	next      Caller
+	policy    RetryPolicy
+	functions map[string]bool
+}
+
+func NewRetry(next Caller, policy RetryPolicy) *Retry {
+	functions := make(map[string]bool)
+	for _, function := range policy.Functions {
+		functions[function] = true
+	}
+
+	return &Retry{
+		next:      next,
+		policy:    policy,
+		functions: functions,
+	}
+}
+
+func (r *Retry) Call(ctx context.Context, gt types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	result, err := r.next.Call(ctx, gt, function, parameters...)
+	if !r.functions[function] {
+		return result, err
+	}
+
+	for attempt := 1; attempt < r.policy.Attempts && err != nil && r.retryable(ctx, err); attempt++ {
+		wait := r.backoff(attempt)
+		log.PrintFields(log.Notice, "retry casino api", "function", function, "gameType", gt, "wait", wait, "attempt", attempt, "error", err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+
+		result, err = r.next.Call(ctx, gt, function, parameters...)
+	}
+
+	return result, err
+}
+
+// retryable returns false when caller gave up, the circuit is open or flash2db refused
+func (r *Retry) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var circuitOpen *CircuitOpenError
+	var businessError *BusinessError
+	return !errors.As(err, &circuitOpen) && !errors.As(err, &businessError)
+}
+
+// backoff returns a random duration up to the exponential backoff of attempt, so
+// retries of many players not hitting flash2db at the same time.
+func (r *Retry) backoff(attempt int) time.Duration {
+	backoff := r.policy.Backoff
+	for i := 1; i < attempt && backoff < r.policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if r.policy.MaxBackoff > 0 && backoff > r.policy.MaxBackoff {
+		backoff = r.policy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
@@ -0,0 +1,140 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+func TestRetry_Call(t *testing.T) {
+	policy := RetryPolicy{
+		Attempts:   3,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 2 * time.Millisecond,
+		Functions:  SafeFunctions,
+	}
+	errFlash2db := errors.New("flash2db not got code 200")
+
+	t.Run("retry safe function until succeed", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db}}
+		retry := NewRetry(stub, policy)
+
+		result, err := retry.Call(context.Background(), 5145, LoginCheck, "sid")
+
+		if err != nil || string(result) != `{"event":true}` {
+			t.Errorf("want result after retry, got %s %v", result, err)
+		}
+		assertCalls(t, stub, 3)
+	})
+
+	t.Run("returns the last error after all attempts failed", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db, errFlash2db, errFlash2db, nil}}
+		retry := NewRetry(stub, policy)
+
+		_, err := retry.Call(context.Background(), 5145, OnLoadInfo)
+
+		if err != errFlash2db {
+			t.Errorf("want error %v, got %v", errFlash2db, err)
+		}
+		assertCalls(t, stub, 3)
+	})
+
+	for _, function := range []string{MachineOccupy, BeginGame, CreditExchange, BalanceExchange, MachineLeave} {
+		t.Run("never retry "+function, func(t *testing.T) {
+			stub := &stubCaller{errs: []error{errFlash2db}}
+			retry := NewRetry(stub, policy)
+
+			_, err := retry.Call(context.Background(), 5145, function)
+
+			if err != errFlash2db {
+				t.Errorf("want error %v, got %v", errFlash2db, err)
+			}
+			assertCalls(t, stub, 1)
+		})
+	}
+
+	t.Run("not retry when circuit open", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{&CircuitOpenError{GameType: 5145}}}
+		retry := NewRetry(stub, policy)
+
+		_, _ = retry.Call(context.Background(), 5145, LoginCheck)
+
+		assertCalls(t, stub, 1)
+	})
+
+	t.Run("not retry when flash2db refused", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{&BusinessError{Function: LoginCheck}}}
+		retry := NewRetry(stub, policy)
+
+		_, _ = retry.Call(context.Background(), 5145, LoginCheck)
+
+		assertCalls(t, stub, 1)
+	})
+
+	t.Run("stop waiting when context canceled", func(t *testing.T) {
+		stub := &stubCaller{errs: []error{errFlash2db}}
+		retry := NewRetry(stub, RetryPolicy{Attempts: 3, Backoff: time.Minute, Functions: SafeFunctions})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+
+		_, err := retry.Call(ctx, 5145, LoginCheck)
+
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+		assertCalls(t, stub, 1)
+	})
+}
+
+func TestRetry_backoff(t *testing.T) {
+	retry := NewRetry(&stubCaller{}, RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond})
+
+	for attempt, max := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond, 5: 30 * time.Millisecond} {
+		for i := 0; i < 100; i++ {
+			if got := retry.backoff(attempt); got <= 0 || got > max {
+				t.Fatalf("attempt %d want backoff in (0, %v], got %v", attempt, max, got)
+			}
+		}
+	}
+}
+
+// stubCaller returns errs in order then succeed
+type stubCaller struct {
+	mutex sync.Mutex
+	errs  []error
+	calls int
+}
+
+func (s *stubCaller) Call(_ context.Context, _ types.GameType, _ string, _ ...interface{}) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.calls++
+	if len(s.errs) > 0 {
+		err := s.errs[0]
+		s.errs = s.errs[1:]
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return []byte(`{"event":true}`), nil
+}
+
+func (s *stubCaller) Calls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.calls
+}
+
+func assertCalls(t *testing.T, stub *stubCaller, want int) {
+	t.Helper()
+	if got := stub.Calls(); got != want {
+		t.Errorf("want %d calls, got %d", want, got)
+	}
+}
@@ -0,0 +1,198 @@
+package casinoapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gode/types"
+)
+
+// RouteConfig map game types and halls to flash2db clusters, e.g.
+//
+//	{
+//	  "clusters": {"asia": ["http://10.0.1.1", "http://10.0.1.2"], "europe": ["http://10.0.2.1"]},
+//	  "routes": [
+//	    {"hallID": 6, "cluster": "asia"},
+//	    {"gameType": 5145, "cluster": "europe"},
+//	    {"gameType": 5145, "hallID": 6, "cluster": "europe"}
+//	  ]
+//	}
+type RouteConfig struct {
+	Clusters map[string][]string `json:"clusters"`
+	Routes   []Route             `json:"routes"`
+}
+
+// Route send calls of GameType and HallID to Cluster, zero GameType or HallID matches any
+type Route struct {
+	GameType types.GameType `json:"gameType"`
+	HallID   types.HallID   `json:"hallID"`
+	Cluster  string         `json:"cluster"`
+}
+
+func ParseRouteConfig(reader io.Reader) (RouteConfig, error) {
+	config := RouteConfig{}
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, fmt.Errorf("parse upstream routes: %v", err)
+	}
+
+	return config, nil
+}
+
+func LoadRouteConfig(path string) (RouteConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return RouteConfig{}, err
+	}
+	defer file.Close()
+
+	return ParseRouteConfig(file)
+}
+
+// Routes resolve the flash2db cluster of a call by game type and the hall in ctx, see WithHall,
+// game type and hall first, then hall, then game type. Load replace the routes at any time.
+type Routes struct {
+	// health checks of clusters stop when ctx done or the cluster replaced
+	ctx     context.Context
+	balance Balance
+	// zero Interval disables health checks
+	check HealthCheck
+
+	// one Load at a time, so unchanged clusters taken from the table in use
+	loadMutex sync.Mutex
+	mutex     sync.RWMutex
+	table     *routeTable
+}
+
+type routeTable struct {
+	upstreams map[routeKey]*Upstreams
+	clusters  map[string]*cluster
+}
+
+type cluster struct {
+	urls      []string
+	upstreams *Upstreams
+	// stop health checks
+	cancel context.CancelFunc
+}
+
+type routeKey struct {
+	gameType types.GameType
+	hallID   types.HallID
+}
+
+// NewRoutes returns routes without any route, nodes of every cluster balanced and health checked the same.
+func NewRoutes(ctx context.Context, balance Balance, check HealthCheck) *Routes {
+	return &Routes{
+		ctx:     ctx,
+		balance: balance,
+		check:   check,
+		table:   &routeTable{upstreams: make(map[routeKey]*Upstreams), clusters: make(map[string]*cluster)},
+	}
+}
+
+// Load replace the routes with config, the routes in use are kept when config invalid.
+// clusters with the same nodes keep their pinned users and health,
+// users of a changed cluster are pinned to its nodes again.
+func (r *Routes) Load(config RouteConfig) error {
+	r.loadMutex.Lock()
+	defer r.loadMutex.Unlock()
+
+	r.mutex.RLock()
+	previous := r.table
+	r.mutex.RUnlock()
+
+	table := &routeTable{upstreams: make(map[routeKey]*Upstreams), clusters: make(map[string]*cluster)}
+	var added []*cluster
+	for name, urls := range config.Clusters {
+		if len(urls) == 0 {
+			return fmt.Errorf("cluster %s: no upstream", name)
+		}
+		if c, ok := previous.clusters[name]; ok && equalURLs(c.urls, urls) {
+			table.clusters[name] = c
+			continue
+		}
+		c := &cluster{urls: urls, upstreams: NewUpstreams(urls, r.balance)}
+		table.clusters[name] = c
+		added = append(added, c)
+	}
+
+	for _, route := range config.Routes {
+		if route.GameType == 0 && route.HallID == 0 {
+			return fmt.Errorf("route to %s: game type or hall is required", route.Cluster)
+		}
+		c, ok := table.clusters[route.Cluster]
+		if !ok {
+			return fmt.Errorf("route of game %d hall %d: unknown cluster %q", route.GameType, route.HallID, route.Cluster)
+		}
+		key := routeKey{gameType: route.GameType, hallID: route.HallID}
+		if _, ok := table.upstreams[key]; ok {
+			return fmt.Errorf("route of game %d hall %d: duplicated", route.GameType, route.HallID)
+		}
+		table.upstreams[key] = c.upstreams
+	}
+
+	for _, c := range added {
+		var ctx context.Context
+		ctx, c.cancel = context.WithCancel(r.ctx)
+		if r.check.Interval > 0 {
+			c.upstreams.StartHealthCheck(ctx, r.check)
+		}
+	}
+
+	r.mutex.Lock()
+	r.table = table
+	r.mutex.Unlock()
+	for name, c := range previous.clusters {
+		if table.clusters[name] != c {
+			c.cancel()
+		}
+	}
+
+	return nil
+}
+
+func equalURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LoadFile replace the routes with the config in path, e.g. on SIGHUP
+func (r *Routes) LoadFile(path string) error {
+	config, err := LoadRouteConfig(path)
+	if err != nil {
+		return err
+	}
+
+	return r.Load(config)
+}
+
+// resolve returns nil when no route matches
+func (r *Routes) resolve(ctx context.Context, gameType types.GameType) *Upstreams {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if hallID, ok := HallFromContext(ctx); ok {
+		if upstreams, ok := r.table.upstreams[routeKey{gameType: gameType, hallID: hallID}]; ok {
+			return upstreams
+		}
+		if upstreams, ok := r.table.upstreams[routeKey{hallID: hallID}]; ok {
+			return upstreams
+		}
+	}
+
+	return r.table.upstreams[routeKey{gameType: gameType}]
+}
@@ -0,0 +1,174 @@
+package casinoapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gode/types"
+)
+
+func TestRoutes_Resolve(t *testing.T) {
+	routes := NewRoutes(context.Background(), RoundRobin, HealthCheck{})
+	err := routes.Load(RouteConfig{
+		Clusters: map[string][]string{"a": {"http://a"}, "b": {"http://b"}, "c": {"http://c"}},
+		Routes: []Route{
+			{HallID: 6, Cluster: "a"},
+			{GameType: 5145, Cluster: "b"},
+			{GameType: 5145, HallID: 6, Cluster: "c"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		gameType types.GameType
+		want     string
+	}{
+		{"game type and hall", WithHall(context.Background(), 6), 5145, "http://c"},
+		{"hall", WithHall(context.Background(), 6), 5156, "http://a"},
+		{"game type", WithHall(context.Background(), 7), 5145, "http://b"},
+		{"game type before login", context.Background(), 5145, "http://b"},
+		{"no route", WithHall(context.Background(), 7), 5156, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := routes.resolve(tt.ctx, tt.gameType)
+			if tt.want == "" {
+				if upstreams != nil {
+					t.Errorf("want no route, got %v", upstreams.Healthy())
+				}
+				return
+			}
+			if upstreams == nil {
+				t.Fatalf("want route to %s, got none", tt.want)
+			}
+			if got := mustAcquire(t, upstreams, tt.ctx); got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoutes_Load(t *testing.T) {
+	invalid := []struct {
+		name   string
+		config RouteConfig
+	}{
+		{"unknown cluster", RouteConfig{Routes: []Route{{HallID: 6, Cluster: "a"}}}},
+		{"cluster without upstream", RouteConfig{Clusters: map[string][]string{"a": {}}}},
+		{"route without game type or hall", RouteConfig{
+			Clusters: map[string][]string{"a": {"http://a"}},
+			Routes:   []Route{{Cluster: "a"}},
+		}},
+		{"duplicated route", RouteConfig{
+			Clusters: map[string][]string{"a": {"http://a"}},
+			Routes:   []Route{{HallID: 6, Cluster: "a"}, {HallID: 6, Cluster: "a"}},
+		}},
+	}
+	for _, tt := range invalid {
+		t.Run("keep routes in use when "+tt.name, func(t *testing.T) {
+			routes := NewRoutes(context.Background(), RoundRobin, HealthCheck{})
+			_ = routes.Load(RouteConfig{
+				Clusters: map[string][]string{"b": {"http://b"}},
+				Routes:   []Route{{HallID: 6, Cluster: "b"}},
+			})
+
+			if err := routes.Load(tt.config); err == nil {
+				t.Fatal("expected an error but didn't get one")
+			}
+			if routes.resolve(WithHall(context.Background(), 6), 5145) == nil {
+				t.Error("want routes in use kept")
+			}
+		})
+	}
+
+	t.Run("keep pinned users of unchanged clusters", func(t *testing.T) {
+		routes := NewRoutes(context.Background(), RoundRobin, HealthCheck{})
+		config := RouteConfig{
+			Clusters: map[string][]string{"a": {"http://a1", "http://a2"}, "b": {"http://b1"}},
+			Routes:   []Route{{HallID: 6, Cluster: "a"}, {HallID: 7, Cluster: "b"}},
+		}
+		if err := routes.Load(config); err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+		ctx := WithHall(WithUser(context.Background(), 9527), 6)
+		other := WithHall(WithUser(context.Background(), 9528), 6)
+		_ = mustAcquire(t, routes.resolve(other, 5145), other)
+		pinned := mustAcquire(t, routes.resolve(ctx, 5145), ctx)
+		a := routes.resolve(ctx, 5145)
+		b := routes.resolve(WithHall(context.Background(), 7), 5145)
+
+		config.Clusters["b"] = []string{"http://b1", "http://b2"}
+		if err := routes.Load(config); err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+
+		if routes.resolve(ctx, 5145) != a {
+			t.Error("want upstreams of unchanged cluster kept")
+		}
+		if got := mustAcquire(t, routes.resolve(ctx, 5145), ctx); got != pinned {
+			t.Errorf("want user pinned to %s, got %s", pinned, got)
+		}
+		if routes.resolve(WithHall(context.Background(), 7), 5145) == b {
+			t.Error("want upstreams of changed cluster replaced")
+		}
+	})
+
+	t.Run("parse config from JSON", func(t *testing.T) {
+		config, err := ParseRouteConfig(strings.NewReader(`{
+			"clusters": {"a": ["http://a"]},
+			"routes": [{"gameType": 5145, "hallID": 6, "cluster": "a"}]
+		}`))
+		if err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+		if len(config.Routes) != 1 || config.Routes[0] != (Route{GameType: 5145, HallID: 6, Cluster: "a"}) {
+			t.Errorf("got %+v", config)
+		}
+
+		if _, err := ParseRouteConfig(strings.NewReader(`{"cluster": {}}`)); err == nil {
+			t.Error("expected an error of unknown field but didn't get one")
+		}
+	})
+}
+
+func TestFlash2db_Call_Routes(t *testing.T) {
+	var defaultCalls, hallCalls int32
+	newServer := func(calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			_, _ = fmt.Fprint(w, `{"event":true}`)
+		}))
+	}
+	defaultServer := newServer(&defaultCalls)
+	defer defaultServer.Close()
+	hallServer := newServer(&hallCalls)
+	defer hallServer.Close()
+
+	routes := NewRoutes(context.Background(), RoundRobin, HealthCheck{})
+	err := routes.Load(RouteConfig{
+		Clusters: map[string][]string{"hall": {hallServer.URL}},
+		Routes:   []Route{{HallID: 6, Cluster: "hall"}},
+	})
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	f := newTestFlash2db(t, defaultServer.URL)
+	f.SetRoutes(routes)
+
+	_, _ = f.Call(context.Background(), 5145, LoginCheck, "sid")
+	_, _ = f.Call(WithHall(context.Background(), 6), 5145, LoginCheck, "sid")
+	_, _ = f.Call(WithHall(context.Background(), 7), 5145, LoginCheck, "sid")
+
+	if defaultCalls != 2 || hallCalls != 1 {
+		t.Errorf("want 2 calls to default and 1 to hall cluster, got %d and %d", defaultCalls, hallCalls)
+	}
+}
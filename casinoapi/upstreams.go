@@ -0,0 +1,276 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gode/log"
+	"gode/types"
+)
+
+// Balance decide which healthy flash2db node a call goes to
+type Balance int
+
+const (
+	RoundRobin Balance = iota
+	// LeastInflight pick the node with the fewest calls in flight
+	LeastInflight
+)
+
+func ParseBalance(balance string) (Balance, error) {
+	switch strings.ToLower(balance) {
+	case "round_robin", "roundrobin":
+		return RoundRobin, nil
+	case "least_inflight", "leastinflight":
+		return LeastInflight, nil
+	}
+
+	return RoundRobin, fmt.Errorf("unknown balance %q", balance)
+}
+
+// StickyTTL is how long a user stays pinned to a node without any call
+const StickyTTL = 30 * time.Minute
+
+var ErrNoHealthyUpstream = errors.New("no healthy flash2db upstream")
+
+// HealthCheck request Path of every node each Interval, a node responds 5xx or not at all
+// Threshold times in a row is unhealthy until it responds again.
+type HealthCheck struct {
+	Interval  time.Duration
+	Timeout   time.Duration
+	Path      string
+	Threshold int
+}
+
+var DefaultHealthCheck = HealthCheck{
+	Interval:  10 * time.Second,
+	Timeout:   2 * time.Second,
+	Path:      PathPrefix,
+	Threshold: 2,
+}
+
+// Upstreams balance calls across flash2db nodes, calls of the same user go to the same node
+// while it's healthy, so the amfphp session state stays on one node.
+type Upstreams struct {
+	nodes   []*node
+	balance Balance
+	// round robin counter
+	next uint64
+
+	mutex sync.Mutex
+	// node of each user with a user in ctx(see WithUser), or session before the user known(see WithSession)
+	pins      map[pinKey]*pin
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+type node struct {
+	url string
+	// 1 when unhealthy, set atomically
+	unhealthy int32
+	inflight  int64
+	// consecutive failed health checks, only accessed by the health check goroutine
+	failures int
+}
+
+type pin struct {
+	node   *node
+	usedAt time.Time
+}
+
+// pinKey is either a user or a session
+type pinKey struct {
+	userID  types.UserID
+	session string
+}
+
+func NewUpstreams(urls []string, balance Balance) *Upstreams {
+	u := &Upstreams{
+		balance: balance,
+		pins:    make(map[pinKey]*pin),
+		now:     time.Now,
+	}
+	for _, url := range urls {
+		u.nodes = append(u.nodes, &node{url: url})
+	}
+
+	return u
+}
+
+// acquire returns the url of the node the call goes to, release must be called when the call done
+func (u *Upstreams) acquire(ctx context.Context) (url string, release func(), err error) {
+	n, err := u.pick(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	atomic.AddInt64(&n.inflight, 1)
+
+	return n.url, func() { atomic.AddInt64(&n.inflight, -1) }, nil
+}
+
+func (u *Upstreams) pick(ctx context.Context) (*node, error) {
+	userID, hasUser := UserFromContext(ctx)
+	sessionID, hasSession := SessionFromContext(ctx)
+	if !hasUser && !hasSession {
+		return u.choose()
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := u.now()
+	u.sweep(now)
+
+	sessionKey := pinKey{session: string(sessionID)}
+	key := sessionKey
+	if hasUser {
+		key = pinKey{userID: userID}
+	}
+	p, ok := u.pins[key]
+	if !ok && hasUser && hasSession {
+		// the user stays on the node answered loginCheck of the session
+		if p, ok = u.pins[sessionKey]; ok {
+			delete(u.pins, sessionKey)
+			u.pins[key] = p
+		}
+	}
+
+	if ok && p.node.isHealthy() {
+		p.usedAt = now
+		return p.node, nil
+	}
+	n, err := u.choose()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		log.PrintFields(log.Info, "user moved from unhealthy flash2db", "userID", userID, "from", p.node.url, "to", n.url)
+	}
+	u.pins[key] = &pin{node: n, usedAt: now}
+
+	return n, nil
+}
+
+// choose a healthy node by balance
+func (u *Upstreams) choose() (*node, error) {
+	if len(u.nodes) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	start := int(atomic.AddUint64(&u.next, 1) % uint64(len(u.nodes)))
+	var chosen *node
+	for i := range u.nodes {
+		n := u.nodes[(start+i)%len(u.nodes)]
+		if !n.isHealthy() {
+			continue
+		}
+		if u.balance == RoundRobin {
+			return n, nil
+		}
+		if chosen == nil || atomic.LoadInt64(&n.inflight) < atomic.LoadInt64(&chosen.inflight) {
+			chosen = n
+		}
+	}
+	if chosen == nil {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	return chosen, nil
+}
+
+// sweep drop pins without calls in StickyTTL, at most once a minute
+func (u *Upstreams) sweep(now time.Time) {
+	if now.Sub(u.lastSweep) < time.Minute {
+		return
+	}
+	u.lastSweep = now
+
+	for key, p := range u.pins {
+		if now.Sub(p.usedAt) > StickyTTL {
+			delete(u.pins, key)
+		}
+	}
+}
+
+func (n *node) isHealthy() bool {
+	return atomic.LoadInt32(&n.unhealthy) == 0
+}
+
+// StartHealthCheck check every node each interval until ctx done, nodes are healthy until checked.
+func (u *Upstreams) StartHealthCheck(ctx context.Context, check HealthCheck) {
+	client := &http.Client{Timeout: check.Timeout}
+	go func() {
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				u.checkAll(ctx, client, check)
+			}
+		}
+	}()
+}
+
+func (u *Upstreams) checkAll(ctx context.Context, client *http.Client, check HealthCheck) {
+	wg := sync.WaitGroup{}
+	for _, n := range u.nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+			n.record(checkHealth(ctx, client, n.url+check.Path), check.Threshold)
+		}(n)
+	}
+	wg.Wait()
+}
+
+// checkHealth returns nil when the node responds anything but 5xx
+func checkHealth(ctx context.Context, client *http.Client, url string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (n *node) record(err error, threshold int) {
+	if err == nil {
+		n.failures = 0
+		if atomic.CompareAndSwapInt32(&n.unhealthy, 1, 0) {
+			log.PrintFields(log.Info, "flash2db healthy", "url", n.url)
+		}
+		return
+	}
+
+	n.failures++
+	if n.failures >= threshold && atomic.CompareAndSwapInt32(&n.unhealthy, 0, 1) {
+		log.PrintFields(log.Warning, "flash2db unhealthy", "url", n.url, "failures", n.failures, "error", err)
+	}
+}
+
+// Healthy returns whether each node is healthy by url
+func (u *Upstreams) Healthy() map[string]bool {
+	healthy := make(map[string]bool, len(u.nodes))
+	for _, n := range u.nodes {
+		healthy[n.url] = n.isHealthy()
+	}
+
+	return healthy
+}
@@ -0,0 +1,187 @@
+package casinoapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+func TestUpstreams_Acquire(t *testing.T) {
+	urls := []string{"http://a", "http://b"}
+
+	t.Run("round robin across nodes", func(t *testing.T) {
+		u := NewUpstreams(urls, RoundRobin)
+
+		got := map[string]int{}
+		for i := 0; i < 4; i++ {
+			url := mustAcquire(t, u, context.Background())
+			got[url]++
+		}
+
+		if got["http://a"] != 2 || got["http://b"] != 2 {
+			t.Errorf("want calls spread evenly, got %v", got)
+		}
+	})
+
+	t.Run("least inflight", func(t *testing.T) {
+		u := NewUpstreams(urls, LeastInflight)
+
+		first, release, err := u.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if url := mustAcquire(t, u, context.Background()); url == first {
+				t.Errorf("want node other than %s busy with a call, got %s", first, url)
+			}
+		}
+		release()
+	})
+
+	t.Run("sticky by user", func(t *testing.T) {
+		u := NewUpstreams(urls, RoundRobin)
+		ctx := WithUser(context.Background(), 100)
+
+		pinned := mustAcquire(t, u, ctx)
+		for i := 0; i < 3; i++ {
+			if url := mustAcquire(t, u, ctx); url != pinned {
+				t.Errorf("want user pinned to %s, got %s", pinned, url)
+			}
+		}
+		if other := mustAcquire(t, u, WithUser(context.Background(), 101)); other == pinned {
+			t.Errorf("want another user on another node, got %s", other)
+		}
+	})
+
+	t.Run("pin the user to the node of its session", func(t *testing.T) {
+		u := NewUpstreams(urls, RoundRobin)
+		session := WithSession(context.Background(), types.SessionID("sid"))
+
+		// loginCheck, before the user known
+		pinned := mustAcquire(t, u, session)
+		if url := mustAcquire(t, u, session); url != pinned {
+			t.Errorf("want session pinned to %s, got %s", pinned, url)
+		}
+		for i := 0; i < 3; i++ {
+			if url := mustAcquire(t, u, WithUser(session, 100)); url != pinned {
+				t.Errorf("want user pinned to %s of its session, got %s", pinned, url)
+			}
+		}
+		if url := mustAcquire(t, u, WithUser(context.Background(), 100)); url != pinned {
+			t.Errorf("want user pinned to %s without session, got %s", pinned, url)
+		}
+		if _, ok := u.pins[pinKey{session: "sid"}]; ok {
+			t.Error("want session unpinned after the user pinned")
+		}
+	})
+
+	t.Run("skip unhealthy nodes and move pinned users", func(t *testing.T) {
+		u := NewUpstreams(urls, RoundRobin)
+		ctx := WithUser(context.Background(), 100)
+
+		pinned := mustAcquire(t, u, ctx)
+		for _, n := range u.nodes {
+			if n.url == pinned {
+				n.record(errors.New("down"), 1)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			if url := mustAcquire(t, u, ctx); url == pinned {
+				t.Errorf("want unhealthy %s skipped", pinned)
+			}
+		}
+	})
+
+	t.Run("returns ErrNoHealthyUpstream when all nodes unhealthy", func(t *testing.T) {
+		u := NewUpstreams(urls, LeastInflight)
+		for _, n := range u.nodes {
+			n.record(errors.New("down"), 1)
+		}
+
+		_, _, err := u.acquire(context.Background())
+		if !errors.Is(err, ErrNoHealthyUpstream) {
+			t.Errorf("want error %v, got %v", ErrNoHealthyUpstream, err)
+		}
+	})
+
+	t.Run("unpin users idle longer than StickyTTL", func(t *testing.T) {
+		now := time.Now()
+		u := NewUpstreams(urls, RoundRobin)
+		u.now = func() time.Time { return now }
+
+		mustAcquire(t, u, WithUser(context.Background(), 100))
+		now = now.Add(StickyTTL + time.Minute)
+		mustAcquire(t, u, WithUser(context.Background(), 101))
+
+		if _, ok := u.pins[pinKey{userID: 100}]; ok {
+			t.Error("want idle user unpinned")
+		}
+	})
+}
+
+func TestUpstreams_StartHealthCheck(t *testing.T) {
+	var status int32 = http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	u := NewUpstreams([]string{server.URL}, RoundRobin)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	u.StartHealthCheck(ctx, HealthCheck{Interval: 5 * time.Millisecond, Timeout: time.Second, Path: PathPrefix, Threshold: 2})
+
+	waitFor(t, func() bool { return !u.Healthy()[server.URL] })
+	atomic.StoreInt32(&status, http.StatusNotFound)
+	waitFor(t, func() bool { return u.Healthy()[server.URL] })
+}
+
+func TestFlash2db_Call_Upstreams(t *testing.T) {
+	var calls [2]int32
+	var urls []string
+	for i := range calls {
+		i := i
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls[i], 1)
+			_, _ = fmt.Fprint(w, `{"event":true}`)
+		}))
+		defer server.Close()
+		urls = append(urls, server.URL)
+	}
+
+	f := newTestFlash2db(t, "")
+	f.SetUpstreams(NewUpstreams(urls, RoundRobin))
+	ctx := WithSession(context.Background(), types.SessionID("sid"))
+	if _, err := f.Call(ctx, 5145, LoginCheck, "sid"); err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	ctx = WithUser(ctx, 100)
+	for i := 0; i < 3; i++ {
+		if _, err := f.Call(ctx, 5145, MachineOccupy, 100, 6, 0); err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+	}
+
+	if !(calls[0] == 4 && calls[1] == 0) && !(calls[0] == 0 && calls[1] == 4) {
+		t.Errorf("want loginCheck and later calls of a user on one node, got %v", calls)
+	}
+}
+
+func mustAcquire(t *testing.T, u *Upstreams, ctx context.Context) string {
+	t.Helper()
+	url, release, err := u.acquire(ctx)
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	release()
+
+	return url
+}
@@ -8,12 +8,17 @@ const (
 	ExchangeCredit   = "creditExchange"
 	ExchangeBalance  = "balanceExchange"
 
-	ReadyResponse            = "ready"
-	LoginResponse            = "onLogin"
-	TakeMachineResponse      = "onTakeMachine"
-	OnLoadInfoResponse       = "onOnLoadInfo2"
-	GetMachineDetailResponse = "onGetMachineDetail"
-	BeginGameResponse        = "onBeginGame"
-	ExchangeCreditResponse   = "onCreditExchange"
-	ExchangeBalanceResponse  = "onBalanceExchange"
+	ReadyResponse             = "ready"
+	LoginResponse             = "onLogin"
+	TakeMachineResponse       = "onTakeMachine"
+	OnLoadInfoResponse        = "onOnLoadInfo2"
+	GetMachineDetailResponse  = "onGetMachineDetail"
+	BeginGameResponse         = "onBeginGame"
+	ExchangeCreditResponse    = "onCreditExchange"
+	ExchangeBalanceResponse   = "onBalanceExchange"
+	LoginRefusedResponse      = "onLoginRefused"
+	LoggedInElsewhereResponse = "onLoggedInElsewhere"
+	ErrorResponse             = "onError"
+	ShutdownResponse          = "onServerShutdown"
+	KickedResponse            = "onKicked"
 )
@@ -1,9 +1,12 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"gode/log"
@@ -27,7 +30,29 @@ type Client struct {
 	HallID    types.HallID
 	SessionID types.SessionID
 
+	RemoteAddr  string
+	ConnectedAt time.Time
+
 	WSConn *websocket.Conn
+
+	// should be set before ServeWS
+	KeepAlive KeepAlive
+	Outbound  Outbound
+
+	// gorilla websocket supports only one concurrent writer, all writes go through send
+	send      chan outboundMsg
+	done      chan struct{}
+	closeOnce sync.Once
+
+	reasonMutex sync.Mutex
+	// why the connection closed, the first reason wins
+	closeReason string
+
+	// canceled when connection closed, stop the api calls of this client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	Session
 }
 
 func ParseData(msg []byte) *WSData {
@@ -59,22 +84,38 @@ func (c *Client) ServeWS(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	c.WSConn = conn
+	c.startWriter()
 
 	return nil
 }
 
+// ListenJSON send valid JSON messages to wsMsg, close wsMsg and the connection when
+// read failed, peer not responding or player idle too long.
 func (c *Client) ListenJSON(wsMsg chan []byte) {
+	deadline := newReadDeadline(c.KeepAlive)
+	_ = c.WSConn.SetReadDeadline(deadline.deadline())
+	// pong handler called in ReadMessage, no need to lock
+	c.WSConn.SetPongHandler(func(string) error {
+		deadline.pong()
+		return c.WSConn.SetReadDeadline(deadline.deadline())
+	})
+
 	for {
 		_, msg, err := c.WSConn.ReadMessage()
 		if err != nil {
 			log.Print(log.Notice, fmt.Sprintf("listenJSON ReadMessage Error: %v", err))
+			c.closeConn(readErrorReason(err))
 			close(wsMsg)
 			break
 		}
 
+		deadline.message()
+		_ = c.WSConn.SetReadDeadline(deadline.deadline())
+
 		//maybe shouldn't valid JSON here
 		if !json.Valid(msg) {
 			log.Print(log.Notice, fmt.Sprintf("listenJSON Valid JSON error, got %q", string(msg)))
+			c.WriteMsg(ErrorMsg(CodeInvalidJSON, "", CodeInvalidJSON.Message()))
 			continue
 		}
 
@@ -82,9 +123,21 @@ func (c *Client) ListenJSON(wsMsg chan []byte) {
 	}
 }
 
+// WriteMsg queue the message, safe for concurrent use.
+// disconnect the slow consumer when queue full.
 func (c *Client) WriteMsg(msg []byte) {
-	err := c.WSConn.WriteMessage(messageType, msg)
-	if err != nil {
-		log.Print(log.Notice, fmt.Sprintf("WriteMsg Error: %v", err))
+	if !c.enqueue(outboundMsg{messageType: messageType, data: msg}) {
+		log.PrintFields(log.Warning, "WriteMsg queue full, disconnect", "userID", c.UserID)
+		c.closeConn(ReasonQueueFull)
+	}
+}
+
+// Close send a close frame with code and reason to peer after queued messages,
+// then close the connection, ListenJSON will stop after connection closed.
+func (c *Client) Close(code int, reason string) {
+	c.setCloseReason(reason)
+	msg := websocket.FormatCloseMessage(code, reason)
+	if !c.enqueue(outboundMsg{messageType: websocket.CloseMessage, data: msg}) {
+		c.closeConn(reason)
 	}
 }
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"gode/log"
+)
+
+// ErrorCode tell the front-end why an action failed
+//
+//	code | meaning                                      | retryable
+//	1000 | message is not valid JSON                    | false
+//	1001 | unknown action                               | false
+//	1002 | action not allowed in current session state  | false
+//	1003 | the same action still in flight              | true
+//	1004 | action not supported by the game             | false
+//	1005 | action sent too fast, rate limited           | true
+//	2000 | casino api call failed                       | true, false for beginGame4, creditExchange and balanceExchange
+//	2001 | login check refused or result invalid        | false
+//	2002 | game unavailable, casino api keeps failing   | false
+//	2003 | casino api refused, responds event false     | false
+type ErrorCode int
+
+const (
+	CodeInvalidJSON        ErrorCode = 1000
+	CodeUnknownAction      ErrorCode = 1001
+	CodeActionNotAllowed   ErrorCode = 1002
+	CodeActionInFlight     ErrorCode = 1003
+	CodeActionNotSupported ErrorCode = 1004
+	CodeRateLimited        ErrorCode = 1005
+
+	CodeAPIError        ErrorCode = 2000
+	CodeLoginFailed     ErrorCode = 2001
+	CodeGameUnavailable ErrorCode = 2002
+	CodeAPIRefused      ErrorCode = 2003
+)
+
+// messages sent to the front-end, errors may carry internal hosts or the session id so only logged
+var codeMessages = map[ErrorCode]string{
+	CodeInvalidJSON:        "invalid JSON",
+	CodeUnknownAction:      "unknown action",
+	CodeActionNotAllowed:   "action not allowed in current state",
+	CodeActionInFlight:     "action in flight",
+	CodeActionNotSupported: "action not supported by the game",
+	CodeRateLimited:        "action sent too fast",
+	CodeAPIError:           "casino api call failed",
+	CodeLoginFailed:        "login failed",
+	CodeGameUnavailable:    "game unavailable",
+	CodeAPIRefused:         "action refused",
+}
+
+func (c ErrorCode) Message() string {
+	return codeMessages[c]
+}
+
+var retryableCodes = map[ErrorCode]bool{
+	CodeActionInFlight: true,
+	CodeRateLimited:    true,
+	CodeAPIError:       true,
+}
+
+// actions move credit or balance, flash2db may have applied the call even if it failed
+var moneyActions = map[string]bool{
+	BeginGame:       true,
+	ExchangeCredit:  true,
+	ExchangeBalance: true,
+}
+
+// Retryable returns whether the front-end can resend the failed action,
+// a failed call of a money moving action is never retryable, resending may bet or exchange twice.
+func (c ErrorCode) Retryable(action string) bool {
+	if c == CodeAPIError && moneyActions[action] {
+		return false
+	}
+
+	return retryableCodes[c]
+}
+
+// ErrorMsg returns the ErrorResponse message of the failed action, message is shown to the player
+func ErrorMsg(code ErrorCode, action string, message string) json.RawMessage {
+	result, marshalErr := json.Marshal(&WSError{
+		Code:      code,
+		Action:    action,
+		Message:   message,
+		Retryable: code.Retryable(action),
+	})
+	if marshalErr != nil {
+		log.Print(log.Notice, fmt.Sprintf("client ErrorMsg JSON Marshal error, %v", marshalErr))
+	}
+
+	return Response(ErrorResponse, result)
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"time"
+)
+
+// KeepAlive detect dead peers, zero value disables all
+type KeepAlive struct {
+	// send ping to peer every PingPeriod, should be less than PongWait
+	PingPeriod time.Duration
+	// disconnect when nothing(pong included) read from peer within PongWait
+	PongWait time.Duration
+	// disconnect when no message from player within IdleTimeout, pong not included
+	IdleTimeout time.Duration
+}
+
+var DefaultKeepAlive = KeepAlive{
+	PingPeriod:  30 * time.Second,
+	PongWait:    60 * time.Second,
+	IdleTimeout: 10 * time.Minute,
+}
+
+// readDeadline keep the time read from peer and decide the read deadline
+type readDeadline struct {
+	keepAlive   KeepAlive
+	lastRead    time.Time
+	lastMessage time.Time
+}
+
+func newReadDeadline(keepAlive KeepAlive) *readDeadline {
+	now := time.Now()
+
+	return &readDeadline{
+		keepAlive:   keepAlive,
+		lastRead:    now,
+		lastMessage: now,
+	}
+}
+
+func (d *readDeadline) pong() {
+	d.lastRead = time.Now()
+}
+
+func (d *readDeadline) message() {
+	d.lastRead = time.Now()
+	d.lastMessage = d.lastRead
+}
+
+// deadline returns the earlier one of pong deadline and idle deadline, zero means no deadline
+func (d *readDeadline) deadline() time.Time {
+	var deadline time.Time
+
+	if d.keepAlive.PongWait > 0 {
+		deadline = d.lastRead.Add(d.keepAlive.PongWait)
+	}
+	if d.keepAlive.IdleTimeout > 0 {
+		idle := d.lastMessage.Add(d.keepAlive.IdleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+
+	return deadline
+}
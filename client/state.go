@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// State of a client connection
+//
+//	Connected -> LoggedIn -> MachineOccupied -> Leaving
+//
+// every state can go to Leaving, and Leaving is the final state.
+type State int
+
+const (
+	Connected State = iota
+	LoggedIn
+	MachineOccupied
+	Leaving
+)
+
+var stateText = map[State]string{
+	Connected:       "connected",
+	LoggedIn:        "logged in",
+	MachineOccupied: "machine occupied",
+	Leaving:         "leaving",
+}
+
+func (s State) String() string {
+	return stateText[s]
+}
+
+// actions allowed in each state
+var allowedActions = map[State]map[string]bool{
+	Connected: {
+		Login: true,
+	},
+	MachineOccupied: {
+		OnLoadInfo:       true,
+		GetMachineDetail: true,
+		BeginGame:        true,
+		ExchangeCredit:   true,
+		ExchangeBalance:  true,
+	},
+}
+
+// IsAction returns true when action is a known client action
+func IsAction(action string) bool {
+	for _, actions := range allowedActions {
+		if actions[action] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// actions can not be handled again before the previous one finished
+var exclusiveActions = map[string]bool{
+	BeginGame: true,
+}
+
+// IsExclusive returns true when action can not be handled again before the previous one finished
+func IsExclusive(action string) bool {
+	return exclusiveActions[action]
+}
+
+var transitions = map[State]State{
+	Connected: LoggedIn,
+	LoggedIn:  MachineOccupied,
+}
+
+// StateError returned when an action or transition is not allowed in current state
+type StateError struct {
+	State  State
+	Action string
+	// true when rejected because the same action is in flight
+	InFlight bool
+}
+
+func (e *StateError) Error() string {
+	if e.InFlight {
+		return fmt.Sprintf("action %s is in flight", e.Action)
+	}
+
+	return fmt.Sprintf("action %s not allowed when %s", e.Action, e.State)
+}
+
+// Session is the state machine of a client connection, safe for concurrent use.
+type Session struct {
+	mutex    sync.Mutex
+	state    State
+	inFlight map[string]bool
+	// actions began and not ended, idle closed when it drops to 0
+	actions int
+	idle    chan struct{}
+
+	lastAction   string
+	lastActionAt time.Time
+}
+
+func (s *Session) State() State {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.state
+}
+
+// Begin check action is allowed in current state and mark exclusive action in flight,
+// End must be called after action handled when Begin returns no error.
+func (s *Session) Begin(action string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.lastAction = action
+	s.lastActionAt = time.Now()
+
+	if !allowedActions[s.state][action] {
+		return &StateError{State: s.state, Action: action}
+	}
+
+	if exclusiveActions[action] {
+		if s.inFlight[action] {
+			return &StateError{State: s.state, Action: action, InFlight: true}
+		}
+		if s.inFlight == nil {
+			s.inFlight = make(map[string]bool)
+		}
+		s.inFlight[action] = true
+	}
+	s.actions++
+	if s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+
+	return nil
+}
+
+// LastAction returns the last action began, allowed or not
+func (s *Session) LastAction() (action string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.lastAction, s.lastActionAt
+}
+
+func (s *Session) End(action string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.inFlight, action)
+	s.actions--
+	if s.actions == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// WaitIdle blocks until no action in flight or ctx done,
+// call it after Leave so no action can begin again.
+func (s *Session) WaitIdle(ctx context.Context) error {
+	s.mutex.Lock()
+	idle := s.idle
+	s.mutex.Unlock()
+
+	if idle == nil {
+		return nil
+	}
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Transit move to the next state, returns error when to is not the next state.
+func (s *Session) Transit(to State) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if next, ok := transitions[s.state]; !ok || next != to {
+		return &StateError{State: s.state, Action: fmt.Sprintf("transit to %s", to)}
+	}
+	s.state = to
+
+	return nil
+}
+
+// Leave move to Leaving and returns the state before leaving,
+// ok is false when already leaving, so the leaving process only happens once.
+func (s *Session) Leave() (previous State, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous = s.state
+	if previous == Leaving {
+		return previous, false
+	}
+	s.state = Leaving
+
+	return previous, true
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSession_Begin(t *testing.T) {
+	testCases := []struct {
+		state   State
+		action  string
+		allowed bool
+	}{
+		{Connected, Login, true},
+		{Connected, OnLoadInfo, false},
+		{Connected, BeginGame, false},
+		{Connected, ExchangeCredit, false},
+		{LoggedIn, Login, false},
+		{LoggedIn, BeginGame, false},
+		{MachineOccupied, Login, false},
+		{MachineOccupied, OnLoadInfo, true},
+		{MachineOccupied, GetMachineDetail, true},
+		{MachineOccupied, BeginGame, true},
+		{MachineOccupied, ExchangeCredit, true},
+		{MachineOccupied, ExchangeBalance, true},
+		{Leaving, BeginGame, false},
+		{Leaving, ExchangeBalance, false},
+	}
+
+	for _, tc := range testCases {
+		s := &Session{state: tc.state}
+		err := s.Begin(tc.action)
+		if tc.allowed && err != nil {
+			t.Errorf("%s should be allowed when %s, got error %v", tc.action, tc.state, err)
+		}
+		if !tc.allowed {
+			assertStateError(t, err, &StateError{State: tc.state, Action: tc.action})
+		}
+	}
+}
+
+func TestSession_InFlight(t *testing.T) {
+	s := &Session{state: MachineOccupied}
+
+	if err := s.Begin(BeginGame); err != nil {
+		t.Fatalf("first beginGame should be allowed, got %v", err)
+	}
+
+	err := s.Begin(BeginGame)
+	assertStateError(t, err, &StateError{State: MachineOccupied, Action: BeginGame, InFlight: true})
+
+	// other actions are not exclusive
+	if err := s.Begin(OnLoadInfo); err != nil {
+		t.Errorf("onLoadInfo should be allowed when beginGame in flight, got %v", err)
+	}
+	if err := s.Begin(OnLoadInfo); err != nil {
+		t.Errorf("onLoadInfo should be allowed twice, got %v", err)
+	}
+
+	s.End(BeginGame)
+	if err := s.Begin(BeginGame); err != nil {
+		t.Errorf("beginGame should be allowed after previous one ended, got %v", err)
+	}
+}
+
+func TestSession_WaitIdle(t *testing.T) {
+	s := &Session{state: MachineOccupied}
+	if err := s.WaitIdle(context.Background()); err != nil {
+		t.Errorf("should not wait when no action in flight, got %v", err)
+	}
+
+	_ = s.Begin(BeginGame)
+	_ = s.Begin(OnLoadInfo)
+	s.Leave()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.WaitIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("should wait actions in flight until ctx done, got %v", err)
+	}
+
+	s.End(BeginGame)
+	s.End(OnLoadInfo)
+	if err := s.WaitIdle(context.Background()); err != nil {
+		t.Errorf("should not wait after actions ended, got %v", err)
+	}
+}
+
+func TestSession_Transit(t *testing.T) {
+	t.Run("go through the normal flow", func(t *testing.T) {
+		s := &Session{}
+		assertState(t, Connected, s.State())
+
+		assertNoError(t, s.Transit(LoggedIn))
+		assertState(t, LoggedIn, s.State())
+
+		assertNoError(t, s.Transit(MachineOccupied))
+		assertState(t, MachineOccupied, s.State())
+	})
+
+	t.Run("can not skip or go back", func(t *testing.T) {
+		s := &Session{}
+		assertStateError(t, s.Transit(MachineOccupied), &StateError{State: Connected, Action: "transit to machine occupied"})
+
+		s = &Session{state: MachineOccupied}
+		assertStateError(t, s.Transit(LoggedIn), &StateError{State: MachineOccupied, Action: "transit to logged in"})
+	})
+
+	t.Run("leave only once from any state", func(t *testing.T) {
+		for _, state := range []State{Connected, LoggedIn, MachineOccupied} {
+			s := &Session{state: state}
+
+			previous, ok := s.Leave()
+			if !ok || previous != state {
+				t.Errorf("want leave from %s, got %s %v", state, previous, ok)
+			}
+
+			_, ok = s.Leave()
+			if ok {
+				t.Errorf("shouldn't leave twice")
+			}
+			assertStateError(t, s.Transit(LoggedIn), &StateError{State: Leaving, Action: "transit to logged in"})
+		}
+	})
+}
+
+func assertState(t *testing.T, want, got State) {
+	t.Helper()
+	if want != got {
+		t.Errorf("want state %s, got %s", want, got)
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+}
+
+func assertStateError(t *testing.T, err error, want *StateError) {
+	t.Helper()
+	var got *StateError
+	if !errors.As(err, &got) {
+		t.Fatalf("expected a StateError, got %v", err)
+	}
+	if *got != *want {
+		t.Errorf("StateError not equal, want %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode/log"
+)
+
+// Outbound decide how messages sent to peer
+type Outbound struct {
+	// messages waiting to be written, peer disconnected when queue full
+	QueueSize int
+	// time limit of writing one message
+	WriteWait time.Duration
+}
+
+var DefaultOutbound = Outbound{
+	QueueSize: 32,
+	WriteWait: 10 * time.Second,
+}
+
+type outboundMsg struct {
+	messageType int
+	data        []byte
+}
+
+// startWriter create the queue and start the only goroutine writes to WSConn
+func (c *Client) startWriter() {
+	queueSize := c.Outbound.QueueSize
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	c.send = make(chan outboundMsg, queueSize)
+	c.done = make(chan struct{})
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.writeLoop()
+}
+
+// writeLoop write queued messages and ping to peer until connection closed
+func (c *Client) writeLoop() {
+	var ping <-chan time.Time
+	if c.KeepAlive.PingPeriod > 0 {
+		ticker := time.NewTicker(c.KeepAlive.PingPeriod)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case msg := <-c.send:
+			err := c.write(msg.messageType, msg.data)
+			if err != nil {
+				log.Print(log.Notice, fmt.Sprintf("writeLoop WriteMessage Error: %v", err))
+				c.closeConn(ReasonWriteError)
+				return
+			}
+			if msg.messageType == websocket.CloseMessage {
+				// reason set by Close
+				c.closeConn("")
+				return
+			}
+
+		case <-ping:
+			err := c.write(websocket.PingMessage, nil)
+			if err != nil {
+				log.Print(log.Notice, fmt.Sprintf("writeLoop ping Error: %v", err))
+				c.closeConn(ReasonWriteError)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) write(messageType int, data []byte) error {
+	if c.Outbound.WriteWait > 0 {
+		_ = c.WSConn.SetWriteDeadline(time.Now().Add(c.Outbound.WriteWait))
+	}
+
+	return c.WSConn.WriteMessage(messageType, data)
+}
+
+// enqueue returns false when queue full
+func (c *Client) enqueue(msg outboundMsg) bool {
+	select {
+	case <-c.done:
+		// connection closed, drop the message
+		return true
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// reasons the connection closed by peer or by the client itself, see CloseReason
+const (
+	ReasonPeerClosed = "peer closed"
+	// nothing read from peer within pong wait, or no message within idle timeout
+	ReasonTimeout    = "timeout"
+	ReasonReadError  = "read error"
+	ReasonWriteError = "write error"
+	ReasonQueueFull  = "send queue full"
+)
+
+// readErrorReason tell peer closing from dead peers
+func readErrorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReasonTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonPeerClosed
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return ReasonPeerClosed
+	}
+
+	return ReasonReadError
+}
+
+func (c *Client) setCloseReason(reason string) {
+	c.reasonMutex.Lock()
+	defer c.reasonMutex.Unlock()
+
+	if c.closeReason == "" {
+		c.closeReason = reason
+	}
+}
+
+// CloseReason returns why the connection closed, the reason of Close or one of the Reason constants,
+// empty when not closed.
+func (c *Client) CloseReason() string {
+	c.reasonMutex.Lock()
+	defer c.reasonMutex.Unlock()
+
+	return c.closeReason
+}
+
+// closeConn close the connection immediately, ListenJSON and writeLoop will stop.
+func (c *Client) closeConn(reason string) {
+	if reason != "" {
+		c.setCloseReason(reason)
+	}
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+		_ = c.WSConn.Close()
+	})
+}
+
+// Cancel cancel the api calls of this client without closing the connection,
+// queued messages are still written.
+func (c *Client) Cancel() {
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// Done returns a channel closed when the connection closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Context returns a context canceled when the connection closed
+func (c *Client) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+
+	return c.ctx
+}
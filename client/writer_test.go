@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode/log"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.Nothing)
+	os.Exit(m.Run())
+}
+
+func TestClient_WriteMsg(t *testing.T) {
+	t.Run("write from many goroutines", func(t *testing.T) {
+		const writers = 10
+		const messages = 10
+		c := &Client{Outbound: Outbound{QueueSize: writers * messages}}
+		peer, closeServer := serveClient(t, c, true)
+		defer closeServer()
+		defer peer.Close()
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < messages; j++ {
+					c.WriteMsg([]byte(fmt.Sprintf(`{"writer":%d}`, i)))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		for i := 0; i < writers*messages; i++ {
+			if _, _, err := peer.ReadMessage(); err != nil {
+				t.Fatalf("want %d messages, got %d, %v", writers*messages, i, err)
+			}
+		}
+	})
+
+	t.Run("disconnect slow consumer when queue full", func(t *testing.T) {
+		c := &Client{}
+		peer, closeServer := serveClient(t, c, false)
+		defer closeServer()
+		defer peer.Close()
+		// writer not started, so nothing drains the queue
+		c.send = make(chan outboundMsg, 1)
+		c.done = make(chan struct{})
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+
+		c.WriteMsg([]byte(`{"n":1}`))
+		select {
+		case <-c.Done():
+			t.Fatalf("shouldn't disconnect before queue full")
+		default:
+		}
+
+		c.WriteMsg([]byte(`{"n":2}`))
+		select {
+		case <-c.Done():
+		case <-time.After(10 * time.Millisecond):
+			t.Fatalf("expected disconnect when queue full")
+		}
+		assertCloseReason(t, c, ReasonQueueFull)
+	})
+
+	t.Run("close after queued messages written", func(t *testing.T) {
+		c := &Client{Outbound: DefaultOutbound}
+		peer, closeServer := serveClient(t, c, true)
+		defer closeServer()
+		defer peer.Close()
+
+		c.WriteMsg([]byte(`{"n":1}`))
+		c.WriteMsg([]byte(`{"n":2}`))
+		c.Close(websocket.CloseGoingAway, "bye")
+		// dropped after closed
+		c.WriteMsg([]byte(`{"n":3}`))
+
+		_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+		for _, want := range []string{`{"n":1}`, `{"n":2}`} {
+			_, got, err := peer.ReadMessage()
+			if err != nil || string(got) != want {
+				t.Fatalf("want %s, got %s %v", want, got, err)
+			}
+		}
+		_, _, err := peer.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("expect close with code %d, got %v", websocket.CloseGoingAway, err)
+		}
+
+		select {
+		case <-c.Done():
+		case <-time.After(10 * time.Millisecond):
+			t.Errorf("expected done closed after close")
+		}
+		assertCloseReason(t, c, "bye")
+	})
+}
+
+func TestClient_Context(t *testing.T) {
+	c := &Client{Outbound: DefaultOutbound}
+	peer, closeServer := serveClient(t, c, true)
+	defer closeServer()
+
+	if err := c.Context().Err(); err != nil {
+		t.Fatalf("context shouldn't be done before disconnect, got %v", err)
+	}
+
+	_ = peer.Close()
+	// ListenJSON close the connection after read failed
+	go c.ListenJSON(make(chan []byte, 1))
+
+	select {
+	case <-c.Context().Done():
+	case <-time.After(time.Second):
+		t.Errorf("expected context canceled after peer disconnected")
+	}
+	assertCloseReason(t, c, ReasonPeerClosed)
+}
+
+func assertCloseReason(t *testing.T, c *Client, want string) {
+	t.Helper()
+	if got := c.CloseReason(); got != want {
+		t.Errorf("want close reason %q, got %q", want, got)
+	}
+}
+
+// serveClient connect c to a peer, start writer when withWriter
+func serveClient(t *testing.T, c *Client, withWriter bool) (peer *websocket.Conn, closeServer func()) {
+	t.Helper()
+	connected := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if withWriter {
+			_ = c.ServeWS(w, r)
+		} else {
+			c.WSConn, _ = wsUpgrader.Upgrade(w, r, nil)
+		}
+		close(connected)
+	}))
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	peer, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("could not open a ws connection on %s %v", url, err)
+	}
+	<-connected
+
+	return peer, server.Close
+}
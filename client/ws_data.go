@@ -18,3 +18,12 @@ type WSResponse struct {
 	Action string          `json:"action"`
 	Result json.RawMessage `json:"result"`
 }
+
+// WSError is the result of ErrorResponse, see errors.go for codes
+type WSError struct {
+	Code ErrorCode `json:"code"`
+	// the action failed, empty when action unknown
+	Action    string `json:"action"`
+	Message   string `json:"message"`
+	Retryable bool   `json:"retryable"`
+}
@@ -1,46 +1,268 @@
 package gode
 
 import (
+	"fmt"
 	"sync"
 
 	"gode/client"
+	"gode/types"
 )
 
 const MaxClients = 100
 
 type ClientPool interface {
 	NumberOfClients() int
+	NumberOfClientsByHallID(types.HallID) int
+	NumberOfClientsByGameType(types.GameType) int
+
+	Clients() []*client.Client
+	ClientByUserID(types.UserID) (*client.Client, bool)
+	ClientsByHallID(types.HallID) []*client.Client
+	ClientsByGameType(types.GameType) []*client.Client
+
+	// only returns an error when reach client limit, the user already registered or closed
 	Register(*client.Client) error
 	Unregister(*client.Client)
+	// refuse registrations with ErrShuttingDown, registered clients are kept
+	Close()
+}
+
+// PoolFullError returned by Register when the global limit or the game type limit is reached.
+// GameType is zero when the global limit is reached.
+type PoolFullError struct {
+	GameType types.GameType
+	Limit    int
+}
+
+func (e *PoolFullError) Error() string {
+	if e.GameType == 0 {
+		return fmt.Sprintf("client pool full, reach limit %d", e.Limit)
+	}
+
+	return fmt.Sprintf("client pool full, game type %d reach limit %d", e.GameType, e.Limit)
+}
+
+// DuplicateUserError returned by Register when another client registered with the same UserID.
+type DuplicateUserError struct {
+	UserID types.UserID
+	// the client registered before
+	Client *client.Client
+}
+
+func (e *DuplicateUserError) Error() string {
+	return fmt.Sprintf("user %d already logged in", e.UserID)
+}
+
+// registration keep the keys a client indexed with,
+// so Unregister still works when client fields changed after Register.
+type registration struct {
+	userID   types.UserID
+	hallID   types.HallID
+	gameType types.GameType
+}
+
+type clientSet map[*client.Client]struct{}
+
+func (s clientSet) list() []*client.Client {
+	clients := make([]*client.Client, 0, len(s))
+	for c := range s {
+		clients = append(clients, c)
+	}
+
+	return clients
+}
+
+type hallIndex map[types.HallID]clientSet
+
+func (i hallIndex) add(hallID types.HallID, c *client.Client) {
+	if i[hallID] == nil {
+		i[hallID] = make(clientSet)
+	}
+	i[hallID][c] = struct{}{}
+}
+
+func (i hallIndex) remove(hallID types.HallID, c *client.Client) {
+	delete(i[hallID], c)
+	if len(i[hallID]) == 0 {
+		delete(i, hallID)
+	}
+}
+
+type gameTypeIndex map[types.GameType]clientSet
+
+func (i gameTypeIndex) add(gameType types.GameType, c *client.Client) {
+	if i[gameType] == nil {
+		i[gameType] = make(clientSet)
+	}
+	i[gameType][c] = struct{}{}
+}
+
+func (i gameTypeIndex) remove(gameType types.GameType, c *client.Client) {
+	delete(i[gameType], c)
+	if len(i[gameType]) == 0 {
+		delete(i, gameType)
+	}
 }
 
 type ClientHub struct {
+	mutex sync.RWMutex
+
 	// Registered clients.
-	clients sync.Map
+	clients map[*client.Client]registration
+
+	// indexes
+	byUserID   map[types.UserID]*client.Client
+	byHallID   hallIndex
+	byGameType gameTypeIndex
+
+	// limits, zero or negative means unlimited
+	maxClients     int
+	gameTypeLimits map[types.GameType]int
+
+	closed bool
 }
 
 func NewClientHub() *ClientHub {
-	return &ClientHub{}
+	return &ClientHub{
+		clients:        make(map[*client.Client]registration),
+		byUserID:       make(map[types.UserID]*client.Client),
+		byHallID:       make(hallIndex),
+		byGameType:     make(gameTypeIndex),
+		maxClients:     MaxClients,
+		gameTypeLimits: make(map[types.GameType]int),
+	}
+}
+
+// SetMaxClients set the global limit, zero or negative means unlimited.
+func (h *ClientHub) SetMaxClients(limit int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.maxClients = limit
 }
 
-func (h *ClientHub) Register(client *client.Client) (err error) {
-	h.clients.Store(client, true)
+// SetGameTypeLimit set the limit of a single game type, zero or negative means unlimited.
+func (h *ClientHub) SetGameTypeLimit(gameType types.GameType, limit int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
 
-	return
+	h.gameTypeLimits[gameType] = limit
+}
+
+// Register add client to hub and index it by UserID, HallID and GameType.
+// a user can only have one registered client.
+func (h *ClientHub) Register(client *client.Client) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.clients[client]; ok {
+		return nil
+	}
+
+	if h.closed {
+		return ErrShuttingDown
+	}
+
+	if registered, ok := h.byUserID[client.UserID]; ok {
+		return &DuplicateUserError{UserID: client.UserID, Client: registered}
+	}
+
+	if h.maxClients > 0 && len(h.clients) >= h.maxClients {
+		return &PoolFullError{Limit: h.maxClients}
+	}
+	limit := h.gameTypeLimits[client.GameType]
+	if limit > 0 && len(h.byGameType[client.GameType]) >= limit {
+		return &PoolFullError{GameType: client.GameType, Limit: limit}
+	}
+
+	r := registration{
+		userID:   client.UserID,
+		hallID:   client.HallID,
+		gameType: client.GameType,
+	}
+	h.clients[client] = r
+	h.byUserID[r.userID] = client
+	h.byHallID.add(r.hallID, client)
+	h.byGameType.add(r.gameType, client)
+
+	return nil
+}
+
+// Close refuse registrations after, so no client registered once Clients listed when shutdown.
+func (h *ClientHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
 }
 
 func (h *ClientHub) Unregister(client *client.Client) {
-	if _, ok := h.clients.Load(client); ok {
-		h.clients.Delete(client)
-		//log.Printf("client deleted from hub, now have %d clients\n", len(clients.clients))
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	r, ok := h.clients[client]
+	if !ok {
+		return
+	}
+
+	delete(h.clients, client)
+	delete(h.byUserID, r.userID)
+	h.byHallID.remove(r.hallID, client)
+	h.byGameType.remove(r.gameType, client)
+}
+
+func (h *ClientHub) NumberOfClients() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.clients)
+}
+
+func (h *ClientHub) NumberOfClientsByHallID(hallID types.HallID) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.byHallID[hallID])
+}
+
+func (h *ClientHub) NumberOfClientsByGameType(gameType types.GameType) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.byGameType[gameType])
+}
+
+func (h *ClientHub) Clients() []*client.Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	clients := make([]*client.Client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
 	}
+
+	return clients
+}
+
+func (h *ClientHub) ClientByUserID(userID types.UserID) (*client.Client, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	c, ok := h.byUserID[userID]
+
+	return c, ok
+}
+
+func (h *ClientHub) ClientsByHallID(hallID types.HallID) []*client.Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return h.byHallID[hallID].list()
 }
 
-func (h *ClientHub) NumberOfClients() (numbers int) {
-	h.clients.Range(func(_, _ interface{}) bool {
-		numbers++
-		return true
-	})
+func (h *ClientHub) ClientsByGameType(gameType types.GameType) []*client.Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
 
-	return
+	return h.byGameType[gameType].list()
 }
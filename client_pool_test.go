@@ -0,0 +1,198 @@
+package gode_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"gode"
+	"gode/client"
+	"gode/types"
+)
+
+func TestClientHub_Register(t *testing.T) {
+	t.Run("returns PoolFullError when reach max clients", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		hub.SetMaxClients(2)
+
+		assertNoError(t, hub.Register(&client.Client{GameType: 5145, UserID: 1}))
+		assertNoError(t, hub.Register(&client.Client{GameType: 5156, UserID: 2}))
+
+		err := hub.Register(&client.Client{GameType: 5145, UserID: 3})
+		assertPoolFull(t, err, &gode.PoolFullError{Limit: 2})
+		assertNumberOfClient(t, 2, hub.NumberOfClients())
+	})
+
+	t.Run("returns PoolFullError when reach game type limit", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		hub.SetGameTypeLimit(5145, 1)
+
+		assertNoError(t, hub.Register(&client.Client{GameType: 5145, UserID: 1}))
+		assertNoError(t, hub.Register(&client.Client{GameType: 5156, UserID: 2}))
+
+		err := hub.Register(&client.Client{GameType: 5145, UserID: 3})
+		assertPoolFull(t, err, &gode.PoolFullError{GameType: 5145, Limit: 1})
+	})
+
+	t.Run("register again after unregister", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		hub.SetMaxClients(1)
+		c := &client.Client{GameType: 5145, UserID: 1}
+
+		assertNoError(t, hub.Register(c))
+		// register same client twice should not take another seat
+		assertNoError(t, hub.Register(c))
+		hub.Unregister(c)
+		hub.Unregister(c)
+
+		assertNoError(t, hub.Register(&client.Client{GameType: 5145, UserID: 1}))
+		assertNumberOfClient(t, 1, hub.NumberOfClients())
+	})
+
+	t.Run("zero means unlimited", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		hub.SetMaxClients(0)
+
+		for i := 0; i < gode.MaxClients+1; i++ {
+			assertNoError(t, hub.Register(&client.Client{GameType: 5145, UserID: types.UserID(i)}))
+		}
+		assertNumberOfClient(t, gode.MaxClients+1, hub.NumberOfClients())
+	})
+
+	t.Run("returns ErrShuttingDown after closed", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		c := &client.Client{GameType: 5145, UserID: 1}
+		assertNoError(t, hub.Register(c))
+
+		hub.Close()
+
+		if err := hub.Register(&client.Client{GameType: 5145, UserID: 2}); !errors.Is(err, gode.ErrShuttingDown) {
+			t.Errorf("want error %v, got %v", gode.ErrShuttingDown, err)
+		}
+		assertNumberOfClient(t, 1, hub.NumberOfClients())
+	})
+
+	t.Run("returns DuplicateUserError when user already registered", func(t *testing.T) {
+		hub := gode.NewClientHub()
+		registered := &client.Client{GameType: 5145, UserID: 1325}
+		assertNoError(t, hub.Register(registered))
+
+		err := hub.Register(&client.Client{GameType: 5156, UserID: 1325})
+		var duplicate *gode.DuplicateUserError
+		if !errors.As(err, &duplicate) {
+			t.Fatalf("expected a DuplicateUserError, got %v", err)
+		}
+		if duplicate.Client != registered {
+			t.Errorf("expected error carry the registered client")
+		}
+		assertNumberOfClient(t, 1, hub.NumberOfClients())
+	})
+}
+
+func TestClientHub_Lookup(t *testing.T) {
+	hub := gode.NewClientHub()
+	c1 := &client.Client{GameType: 5145, UserID: 1325, HallID: 10}
+	c2 := &client.Client{GameType: 5145, UserID: 1326, HallID: 10}
+	c3 := &client.Client{GameType: 5156, UserID: 1327, HallID: 6}
+	for _, c := range []*client.Client{c1, c2, c3} {
+		assertNoError(t, hub.Register(c))
+	}
+
+	t.Run("find client by user id", func(t *testing.T) {
+		got, ok := hub.ClientByUserID(1325)
+		if !ok || got != c1 {
+			t.Errorf("want client %p, got %p", c1, got)
+		}
+
+		_, ok = hub.ClientByUserID(9999)
+		if ok {
+			t.Errorf("shouldn't find client of user 9999")
+		}
+	})
+
+	t.Run("find clients by hall id and game type", func(t *testing.T) {
+		assertClientsContains(t, hub.ClientsByHallID(10), c1, c2)
+		assertClientsContains(t, hub.ClientsByHallID(6), c3)
+		assertClientsContains(t, hub.ClientsByGameType(5145), c1, c2)
+		assertClientsContains(t, hub.ClientsByGameType(5156), c3)
+		assertClientsContains(t, hub.ClientsByGameType(5188))
+	})
+
+	t.Run("count clients by hall id and game type", func(t *testing.T) {
+		assertNumberOfClient(t, 2, hub.NumberOfClientsByHallID(10))
+		assertNumberOfClient(t, 2, hub.NumberOfClientsByGameType(5145))
+		assertNumberOfClient(t, 1, hub.NumberOfClientsByGameType(5156))
+	})
+
+	t.Run("remove from indexes after unregister", func(t *testing.T) {
+		hub.Unregister(c1)
+
+		if _, ok := hub.ClientByUserID(1325); ok {
+			t.Errorf("shouldn't find client of user 1325 after unregister")
+		}
+		assertClientsContains(t, hub.ClientsByHallID(10), c2)
+		assertNumberOfClient(t, 1, hub.NumberOfClientsByGameType(5145))
+	})
+}
+
+func TestClientHub_Concurrency(t *testing.T) {
+	const workers = 50
+	hub := gode.NewClientHub()
+	hub.SetMaxClients(0)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := &client.Client{GameType: 5145, UserID: types.UserID(i), HallID: types.HallID(i % 5)}
+			_ = hub.Register(c)
+			_, _ = hub.ClientByUserID(c.UserID)
+			_ = hub.ClientsByHallID(c.HallID)
+			_ = hub.NumberOfClientsByGameType(c.GameType)
+			if i%2 == 0 {
+				hub.Unregister(c)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assertNumberOfClient(t, workers/2, hub.NumberOfClients())
+	assertNumberOfClient(t, workers/2, hub.NumberOfClientsByGameType(5145))
+}
+
+func assertClientsContains(t *testing.T, got []*client.Client, want ...*client.Client) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("want %d clients, got %d", len(want), len(got))
+	}
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("client %+v not found in %v", w, got)
+		}
+	}
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+}
+
+func assertPoolFull(t *testing.T, err error, want *gode.PoolFullError) {
+	t.Helper()
+	var got *gode.PoolFullError
+	if !errors.As(err, &got) {
+		t.Fatalf("expected a PoolFullError, got %v", err)
+	}
+	if *got != *want {
+		t.Errorf("PoolFullError not equal, want %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,232 @@
+// fake_flash2db serves flash2db responses from fixture files, so gode runs without a real flash2db.
+//
+//	$ go run cmd/fake_flash2db/fake_flash2db.go -addr :8000 -fixtures cmd/fake_flash2db/fixtures
+//
+// a fixture named {service}.{function}.json or {function}.json holds a response, or an array of
+// responses returned in turn. loginCheck accepts only the sessions in sessions.json.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gode/casinoapi"
+	"gode/log"
+)
+
+// SessionsFile in fixtures maps session id to the user loginCheck returns
+const SessionsFile = "sessions.json"
+
+func main() {
+	addr := flag.String("addr", ":8000", "listen address")
+	fixtures := flag.String("fixtures", "cmd/fake_flash2db/fixtures", "directory of fixture files")
+	latency := flag.Duration("latency", 0, "delay before every response")
+	errorRate := flag.Float64("error-rate", 0, "probability of responding 500, 0 to 1")
+	logLevel := flag.String("log-level", "info", "log level")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	flag.Parse()
+
+	log.SetLevel(log.ParseLogLevel(*logLevel))
+	log.SetFormat(log.ParseFormat(*logFormat))
+
+	fake, err := newFakeFlash2db(*fixtures)
+	if err != nil {
+		log.Fatal("error loading fixtures ", err)
+	}
+	fake.latency = *latency
+	fake.errorRate = *errorRate
+
+	log.Print(log.Info, fmt.Sprintf("fake flash2db listen on %s", *addr))
+	log.Fatal(http.ListenAndServe(*addr, fake))
+}
+
+type fakeFlash2db struct {
+	// responses by fixture name, e.g. "beginGame" or "casino.slot.line243.BuBuGaoSheng.beginGame"
+	responses map[string][]json.RawMessage
+	// user of each accepted session
+	sessions map[string]json.RawMessage
+
+	latency   time.Duration
+	errorRate float64
+
+	mutex sync.Mutex
+	// times each fixture responded, to return scripted responses in turn
+	served map[string]int
+}
+
+func newFakeFlash2db(dir string) (*fakeFlash2db, error) {
+	f := &fakeFlash2db{
+		responses: make(map[string][]json.RawMessage),
+		sessions:  make(map[string]json.RawMessage),
+		served:    make(map[string]int),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		if filepath.Base(path) == SessionsFile {
+			if err := json.Unmarshal(content, &f.sessions); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			continue
+		}
+
+		responses, err := parseResponses(content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		f.responses[name] = responses
+	}
+
+	return f, nil
+}
+
+// parseResponses returns the responses in an array, or the only response
+func parseResponses(content []byte) ([]json.RawMessage, error) {
+	var responses []json.RawMessage
+	if err := json.Unmarshal(content, &responses); err == nil {
+		if len(responses) == 0 {
+			return nil, fmt.Errorf("no response")
+		}
+		return responses, nil
+	}
+
+	var response json.RawMessage
+	if err := json.Unmarshal(content, &response); err != nil {
+		return nil, err
+	}
+
+	return []json.RawMessage{response}, nil
+}
+
+func (f *fakeFlash2db) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service, function, parameters, err := parseRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Print(log.Info, fmt.Sprintf("%s %s.%s %q", r.Method, service, function, parameters))
+
+	if f.latency > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(f.latency):
+		}
+	}
+	if f.errorRate > 0 && rand.Float64() < f.errorRate {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var response json.RawMessage
+	if function == casinoapi.LoginCheck {
+		response = f.loginCheck(parameters)
+	} else {
+		var ok bool
+		response, ok = f.next(service, function)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(response)
+}
+
+// parseRequest read service, function and parameters like json.php, parameters are in the path,
+// or in the body when posted as JSON array or form values.
+func parseRequest(r *http.Request) (service, function string, parameters []string, err error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), casinoapi.PathPrefix+"/")
+	if path == r.URL.EscapedPath() {
+		return "", "", nil, fmt.Errorf("not under %s", casinoapi.PathPrefix)
+	}
+
+	segments := strings.Split(path, "/")
+	dot := strings.LastIndex(segments[0], ".")
+	if dot < 1 {
+		return "", "", nil, fmt.Errorf("invalid service and function %q", segments[0])
+	}
+	service, function = segments[0][:dot], segments[0][dot+1:]
+
+	for _, segment := range segments[1:] {
+		parameter, err := url.QueryUnescape(segment)
+		if err != nil {
+			return "", "", nil, err
+		}
+		parameters = append(parameters, parameter)
+	}
+
+	if r.Method != http.MethodPost {
+		return service, function, parameters, nil
+	}
+	if r.Header.Get("Content-Type") == "application/json" {
+		err = json.NewDecoder(r.Body).Decode(&parameters)
+		return service, function, parameters, err
+	}
+	if err := r.ParseForm(); err != nil {
+		return "", "", nil, err
+	}
+
+	return service, function, r.PostForm[casinoapi.FormParameters], nil
+}
+
+// next returns the next scripted response of {service}.{function}, or of {function}
+func (f *fakeFlash2db) next(service, function string) (json.RawMessage, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, name := range []string{service + "." + function, function} {
+		responses, ok := f.responses[name]
+		if !ok {
+			continue
+		}
+		response := responses[f.served[name]%len(responses)]
+		f.served[name]++
+
+		return response, true
+	}
+
+	return nil, false
+}
+
+// loginCheck accept the sessions in SessionsFile, the first parameter is session id
+func (f *fakeFlash2db) loginCheck(parameters []string) json.RawMessage {
+	var sid string
+	if len(parameters) > 0 {
+		sid = parameters[0]
+	}
+
+	user, ok := f.sessions[sid]
+	if !ok {
+		return json.RawMessage(`{"event":false,"data":{"code":"SESSION_INVALID","message":"session not found"}}`)
+	}
+
+	response, _ := json.Marshal(map[string]interface{}{
+		"event": true,
+		"data": map[string]interface{}{
+			"user":    user,
+			"session": map[string]string{"session": sid, "create_at": time.Now().Format("2006-01-02 15:04:05")},
+		},
+	})
+
+	return response
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gode/casinoapi"
+	"gode/games"
+	"gode/log"
+	"gode/types"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.Nothing)
+	os.Exit(m.Run())
+}
+
+func TestFakeFlash2db(t *testing.T) {
+	const gameType = types.GameType(5145)
+
+	newFlash2db := func(t *testing.T, fake *fakeFlash2db, transport string) *casinoapi.Flash2db {
+		t.Helper()
+		server := httptest.NewServer(fake)
+		t.Cleanup(server.Close)
+
+		registry, err := games.NewRegistry(games.Game{GameType: gameType, Service: "casino.slot.line243.BuBuGaoSheng", Enabled: true, Transport: transport})
+		if err != nil {
+			t.Fatalf("could not create registry, %v", err)
+		}
+		return casinoapi.NewFlash2db(server.URL, registry)
+	}
+
+	for _, transport := range []string{games.TransportPath, games.TransportJSON, games.TransportForm} {
+		t.Run("accept sessions in fixtures by "+transport, func(t *testing.T) {
+			f := newFlash2db(t, mustNewFake(t), transport)
+
+			result, err := f.Call(context.Background(), gameType, casinoapi.LoginCheck, types.SessionID("19870604xi"))
+
+			login := &casinoapi.LoginCheckResult{}
+			if err := casinoapi.Decode(casinoapi.LoginCheck, result, login); err != nil {
+				t.Fatalf("could not decode loginCheck result %s, %v", result, err)
+			}
+			if err != nil || login.Data.User.UserID != 9527 || login.Data.User.HallID != 6 || login.Data.Session.Session.String() != "19870604xi" {
+				t.Errorf("want user 9527 of hall 6, got %+v %v", login.Data, err)
+			}
+		})
+	}
+
+	t.Run("refuse unknown sessions", func(t *testing.T) {
+		f := newFlash2db(t, mustNewFake(t), "")
+
+		_, err := f.Call(context.Background(), gameType, casinoapi.LoginCheck, types.SessionID("unknown"))
+
+		var businessError *casinoapi.BusinessError
+		if !errors.As(err, &businessError) {
+			t.Errorf("want BusinessError, got %v", err)
+		}
+	})
+
+	t.Run("return scripted responses in turn", func(t *testing.T) {
+		f := newFlash2db(t, mustNewFake(t), "")
+		call := func() (*casinoapi.BeginGameResult, error) {
+			result, err := f.Call(context.Background(), gameType, casinoapi.BeginGame, types.SessionID("19870604xi"), types.GameCode(0), types.BetInfo(`{"BetLevel":5}`))
+			if err != nil {
+				return nil, err
+			}
+			beginGame := &casinoapi.BeginGameResult{}
+			return beginGame, casinoapi.Decode(casinoapi.BeginGame, result, beginGame)
+		}
+
+		for _, wagersID := range []string{"10001", "10002"} {
+			beginGame, err := call()
+			if err != nil || beginGame.Data.WagersID != wagersID {
+				t.Fatalf("want wagers %s, got %+v %v", wagersID, beginGame, err)
+			}
+		}
+		var businessError *casinoapi.BusinessError
+		if _, err := call(); !errors.As(err, &businessError) {
+			t.Errorf("want BusinessError, got %v", err)
+		}
+		if beginGame, err := call(); err != nil || beginGame.Data.WagersID != "10001" {
+			t.Errorf("want scripted responses start over, got %+v %v", beginGame, err)
+		}
+	})
+
+	t.Run("fixture of service first", func(t *testing.T) {
+		fake := mustNewFake(t)
+		fake.responses["casino.slot.line243.BuBuGaoSheng.onLoadInfo"] = mustParseResponses(t, `{"event":true,"data":{"Credit":"5566"}}`)
+		f := newFlash2db(t, fake, "")
+
+		result, err := f.Call(context.Background(), gameType, casinoapi.OnLoadInfo, types.UserID(9527), types.GameCode(0))
+
+		onLoadInfo := &casinoapi.OnLoadInfoResult{}
+		if err != nil || casinoapi.Decode(casinoapi.OnLoadInfo, result, onLoadInfo) != nil || onLoadInfo.Data.Credit != "5566" {
+			t.Errorf("want credit of service fixture, got %s %v", result, err)
+		}
+	})
+
+	t.Run("returns error when function has no fixture", func(t *testing.T) {
+		f := newFlash2db(t, mustNewFake(t), "")
+
+		if _, err := f.Call(context.Background(), gameType, "notExists"); err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+
+	t.Run("inject errors", func(t *testing.T) {
+		fake := mustNewFake(t)
+		fake.errorRate = 1
+		f := newFlash2db(t, fake, "")
+
+		if _, err := f.Call(context.Background(), gameType, casinoapi.MachineLeave, types.UserID(9527), types.HallID(6), types.GameCode(0)); err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+}
+
+func TestNewFakeFlash2db(t *testing.T) {
+	t.Run("returns error when fixture invalid", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "fixtures")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, "beginGame.json"), []byte(`[]`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := newFakeFlash2db(dir); err == nil {
+			t.Errorf("expected an error but not got one")
+		}
+	})
+}
+
+func mustNewFake(t *testing.T) *fakeFlash2db {
+	t.Helper()
+	fake, err := newFakeFlash2db("fixtures")
+	if err != nil {
+		t.Fatalf("could not load fixtures, %v", err)
+	}
+
+	return fake
+}
+
+func mustParseResponses(t *testing.T, content string) []json.RawMessage {
+	t.Helper()
+	responses, err := parseResponses([]byte(content))
+	if err != nil {
+		t.Fatalf("could not parse responses, %v", err)
+	}
+
+	return responses
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"gode"
 	"gode/casinoapi"
+	"gode/client"
+	"gode/games"
 	"gode/log"
+	"gode/metrics"
+	"gode/types"
 )
 
 func main() {
@@ -18,10 +29,577 @@ func main() {
 
 	//set log level
 	log.SetLevel(log.ParseLogLevel(os.Getenv("LOG_LEVEL")))
+	// text or json
+	log.SetFormat(log.ParseFormat(os.Getenv("LOG_FORMAT")))
+
+	registry, err := games.LoadRegistry(os.Getenv("GAME_REGISTRY"))
+	if err != nil {
+		log.Fatal("error loading game registry ", err)
+	}
 
 	clientPool := gode.NewClientHub()
-	caller := casinoapi.NewFlash2db(os.Getenv("FLASH2DB_URL"))
+	if err := setClientLimits(clientPool); err != nil {
+		log.Fatal("error parsing client limits ", err)
+	}
+	// stop health checks on exit
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	upstream, err := newUpstream(ctx, registry)
+	if err != nil {
+		log.Fatal("error creating casino api upstream ", err)
+	}
+	// metrics served on METRICS_ADDR(e.g. "127.0.0.1:9100"), disabled when empty
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	var metricsRegistry *metrics.Registry
+	if metricsAddr != "" {
+		metricsRegistry = metrics.NewRegistry()
+	}
+	middlewares, err := parseMiddlewares(metricsRegistry)
+	if err != nil {
+		log.Fatal("error parsing casino api middlewares ", err)
+	}
+	if metricsRegistry != nil {
+		// innermost, every call to flash2db measured
+		middlewares = append(middlewares, casinoapi.WithMetrics(metricsRegistry))
+	}
+	caller := casinoapi.Chain(upstream, middlewares...)
 	server := gode.NewServer(clientPool, caller)
+	server.SetGameRegistry(registry)
+	if metricsRegistry != nil {
+		server.SetMetrics(metricsRegistry)
+	}
+	if err := setDuplicateLoginPolicy(server); err != nil {
+		log.Fatal("error parsing duplicate login policy ", err)
+	}
+
+	if err := setRateLimits(server); err != nil {
+		log.Fatal("error parsing rate limits ", err)
+	}
+
+	if err := setKeepAlive(server); err != nil {
+		log.Fatal("error parsing keep alive ", err)
+	}
+	if err := setOutbound(server); err != nil {
+		log.Fatal("error parsing outbound ", err)
+	}
+	if err := setShutdownConcurrency(server); err != nil {
+		log.Fatal("error parsing shutdown concurrency ", err)
+	}
+	shutdownTimeout, err := parseShutdownTimeout()
+	if err != nil {
+		log.Fatal("error parsing shutdown timeout ", err)
+	}
+
+	httpServer := &http.Server{Addr: ":80", Handler: server}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// admin api listen on ADMIN_ADDR(e.g. "127.0.0.1:8080"), disabled when empty
+	var adminServer *http.Server
+	if adminAddr := os.Getenv("ADMIN_ADDR"); adminAddr != "" {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			log.Fatal("ADMIN_TOKEN is required when ADMIN_ADDR set")
+		}
+		adminServer = &http.Server{Addr: adminAddr, Handler: server.AdminHandler(adminToken)}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var metricsServer *http.Server
+	if metricsRegistry != nil {
+		router := http.NewServeMux()
+		router.Handle("/metrics", metricsRegistry.Handler())
+		metricsServer = &http.Server{Addr: metricsAddr, Handler: router}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+
+	log.Print(log.Info, "shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Print(log.Error, fmt.Sprintf("shutdown not finished: %v", err))
+	}
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		log.Print(log.Error, fmt.Sprintf("http server shutdown error: %v", err))
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(shutdownCtx); err != nil {
+			log.Print(log.Error, fmt.Sprintf("admin server shutdown error: %v", err))
+		}
+	}
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+			log.Print(log.Error, fmt.Sprintf("metrics server shutdown error: %v", err))
+		}
+	}
+}
+
+// newUpstream returns flash2db, or replay the calls recorded in API_REPLAY_FILE when set
+func newUpstream(ctx context.Context, registry *games.Registry) (casinoapi.Caller, error) {
+	if replayFile := os.Getenv("API_REPLAY_FILE"); replayFile != "" {
+		log.Print(log.Warning, fmt.Sprintf("replay casino api calls recorded in %s", replayFile))
+		return casinoapi.LoadReplay(replayFile)
+	}
+
+	upstreams, err := newUpstreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := newRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	flash2db := casinoapi.NewFlash2db("", registry)
+	flash2db.SetUpstreams(upstreams)
+	if routes != nil {
+		flash2db.SetRoutes(routes)
+	}
+
+	return flash2db, nil
+}
+
+// newUpstreams read FLASH2DB_URL(comma separated nodes), health checked when interval not 0
+func newUpstreams(ctx context.Context) (*casinoapi.Upstreams, error) {
+	balance, check, err := parseUpstreamPolicy()
+	if err != nil {
+		return nil, err
+	}
+	urls := strings.Split(strings.ReplaceAll(os.Getenv("FLASH2DB_URL"), " ", ""), ",")
+	upstreams := casinoapi.NewUpstreams(urls, balance)
+	if check.Interval > 0 {
+		upstreams.StartHealthCheck(ctx, check)
+	}
+
+	return upstreams, nil
+}
+
+// newRoutes load the routes in UPSTREAM_ROUTES and reload them on SIGHUP, nil when not set
+func newRoutes(ctx context.Context) (*casinoapi.Routes, error) {
+	path := os.Getenv("UPSTREAM_ROUTES")
+	if path == "" {
+		return nil, nil
+	}
+	balance, check, err := parseUpstreamPolicy()
+	if err != nil {
+		return nil, err
+	}
+	routes := casinoapi.NewRoutes(ctx, balance, check)
+	if err := routes.LoadFile(path); err != nil {
+		return nil, fmt.Errorf("UPSTREAM_ROUTES: %v", err)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(reload)
+				return
+			case <-reload:
+				if err := routes.LoadFile(path); err != nil {
+					log.Print(log.Error, fmt.Sprintf("reload upstream routes error, keep routes in use: %v", err))
+					continue
+				}
+				log.Print(log.Info, fmt.Sprintf("upstream routes reloaded from %s", path))
+			}
+		}
+	}()
+
+	return routes, nil
+}
+
+// parseUpstreamPolicy read FLASH2DB_BALANCE, and FLASH2DB_HEALTH_INTERVAL, FLASH2DB_HEALTH_TIMEOUT,
+// FLASH2DB_HEALTH_PATH, FLASH2DB_HEALTH_THRESHOLD of health checks, interval 0 disables.
+func parseUpstreamPolicy() (casinoapi.Balance, casinoapi.HealthCheck, error) {
+	check := casinoapi.DefaultHealthCheck
+	balance := casinoapi.RoundRobin
+	if value := os.Getenv("FLASH2DB_BALANCE"); value != "" {
+		var err error
+		if balance, err = casinoapi.ParseBalance(value); err != nil {
+			return balance, check, fmt.Errorf("FLASH2DB_BALANCE: %v", err)
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"FLASH2DB_HEALTH_INTERVAL": &check.Interval,
+		"FLASH2DB_HEALTH_TIMEOUT":  &check.Timeout,
+	}
+	if err := parseDurations(durations); err != nil {
+		return balance, check, err
+	}
+	if path := os.Getenv("FLASH2DB_HEALTH_PATH"); path != "" {
+		check.Path = path
+	}
+	if threshold := os.Getenv("FLASH2DB_HEALTH_THRESHOLD"); threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil {
+			return balance, check, fmt.Errorf("FLASH2DB_HEALTH_THRESHOLD: %v", err)
+		}
+		check.Threshold = n
+	}
+
+	return balance, check, nil
+}
+
+// parseMiddlewares read API_MIDDLEWARES, the casino api middlewares from outermost to innermost,
+// e.g. "logging,breaker,retry", the default is "cache,coalesce,breaker,retry" so the breaker counts calls failed after retries.
+func parseMiddlewares(metricsRegistry *metrics.Registry) ([]casinoapi.Middleware, error) {
+	names := os.Getenv("API_MIDDLEWARES")
+	if names == "" {
+		names = "cache,coalesce,breaker,retry"
+	}
+
+	var middlewares []casinoapi.Middleware
+	for _, name := range strings.Split(names, ",") {
+		var middleware casinoapi.Middleware
+		var err error
+		switch strings.TrimSpace(name) {
+		case "logging":
+			middleware = casinoapi.WithLogging()
+		case "breaker":
+			middleware, err = breakerMiddleware()
+		case "retry":
+			middleware, err = retryMiddleware()
+		case "faults":
+			middleware, err = faultsMiddleware()
+		case "record":
+			middleware, err = recordMiddleware()
+		case "cache":
+			middleware, err = cacheMiddleware()
+		case "coalesce":
+			middleware = coalesceMiddleware(metricsRegistry)
+		default:
+			err = fmt.Errorf("unknown middleware %q", name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("API_MIDDLEWARES: %v", err)
+		}
+		middlewares = append(middlewares, middleware)
+	}
+
+	return middlewares, nil
+}
+
+// retryMiddleware read API_RETRY_ATTEMPTS, API_RETRY_BACKOFF, API_RETRY_MAX_BACKOFF and API_RETRY_FUNCTIONS
+func retryMiddleware() (casinoapi.Middleware, error) {
+	policy := casinoapi.DefaultRetryPolicy
+	if attempts := os.Getenv("API_RETRY_ATTEMPTS"); attempts != "" {
+		n, err := strconv.Atoi(attempts)
+		if err != nil {
+			return nil, fmt.Errorf("API_RETRY_ATTEMPTS: %v", err)
+		}
+		policy.Attempts = n
+	}
+	durations := map[string]*time.Duration{
+		"API_RETRY_BACKOFF":     &policy.Backoff,
+		"API_RETRY_MAX_BACKOFF": &policy.MaxBackoff,
+	}
+	if err := parseDurations(durations); err != nil {
+		return nil, err
+	}
+	if functions := os.Getenv("API_RETRY_FUNCTIONS"); functions != "" {
+		policy.Functions = strings.Split(strings.ReplaceAll(functions, " ", ""), ",")
+	}
+
+	return casinoapi.WithRetry(policy), nil
+}
+
+// breakerMiddleware read API_BREAKER_THRESHOLD and API_BREAKER_OPEN_TIMEOUT
+func breakerMiddleware() (casinoapi.Middleware, error) {
+	policy := casinoapi.DefaultBreakerPolicy
+	if threshold := os.Getenv("API_BREAKER_THRESHOLD"); threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil {
+			return nil, fmt.Errorf("API_BREAKER_THRESHOLD: %v", err)
+		}
+		policy.Threshold = n
+	}
+	if err := parseDurations(map[string]*time.Duration{"API_BREAKER_OPEN_TIMEOUT": &policy.OpenTimeout}); err != nil {
+		return nil, err
+	}
+
+	return casinoapi.WithBreaker(policy), nil
+}
+
+// faultsMiddleware read API_FAULT_LATENCY and API_FAULT_ERROR_RATE(0 to 1)
+func faultsMiddleware() (casinoapi.Middleware, error) {
+	faults := casinoapi.Faults{}
+	if err := parseDurations(map[string]*time.Duration{"API_FAULT_LATENCY": &faults.Latency}); err != nil {
+		return nil, err
+	}
+	if rate := os.Getenv("API_FAULT_ERROR_RATE"); rate != "" {
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil {
+			return nil, fmt.Errorf("API_FAULT_ERROR_RATE: %v", err)
+		}
+		faults.ErrorRate = f
+	}
+	log.Print(log.Warning, fmt.Sprintf("casino api faults injected, %+v", faults))
+
+	return casinoapi.WithFaults(faults), nil
+}
+
+// cacheMiddleware read API_CACHE_TTLS(e.g. "onLoadInfo:5s,getMachineDetail:5s") and
+// API_CACHE_INVALIDATE(e.g. "beginGame,creditExchange,balanceExchange")
+func cacheMiddleware() (casinoapi.Middleware, error) {
+	policy := casinoapi.DefaultCachePolicy
+	if ttls := os.Getenv("API_CACHE_TTLS"); ttls != "" {
+		policy.TTLs = make(map[string]time.Duration)
+		for _, pair := range strings.Split(ttls, ",") {
+			kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("API_CACHE_TTLS: invalid pair %q", pair)
+			}
+			ttl, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+			if err != nil {
+				return nil, fmt.Errorf("API_CACHE_TTLS: %v", err)
+			}
+			policy.TTLs[kv[0]] = ttl
+		}
+	}
+	if invalidate := os.Getenv("API_CACHE_INVALIDATE"); invalidate != "" {
+		policy.Invalidate = strings.Split(strings.ReplaceAll(invalidate, " ", ""), ",")
+	}
+
+	return casinoapi.WithCache(policy), nil
+}
+
+// coalesceMiddleware read API_COALESCE_FUNCTIONS, read only functions merged when called concurrently,
+// calls saved are exposed when metricsRegistry not nil.
+func coalesceMiddleware(metricsRegistry *metrics.Registry) casinoapi.Middleware {
+	functions := casinoapi.SafeFunctions
+	if names := os.Getenv("API_COALESCE_FUNCTIONS"); names != "" {
+		functions = strings.Split(strings.ReplaceAll(names, " ", ""), ",")
+	}
+	if metricsRegistry == nil {
+		return casinoapi.WithCoalesce(functions)
+	}
+
+	return func(next casinoapi.Caller) casinoapi.Caller {
+		coalesce := casinoapi.NewCoalesce(next, functions)
+		metricsRegistry.NewCounterFunc("gode_casino_api_coalesced_total", "Casino api calls merged into another by function.", []string{"function"}, func(emit metrics.Emit) {
+			for function, n := range coalesce.Saved() {
+				emit(float64(n), function)
+			}
+		})
+
+		return coalesce
+	}
+}
+
+// recordMiddleware append calls to API_RECORD_FILE as NDJSON, the file is left open until exit
+func recordMiddleware() (casinoapi.Middleware, error) {
+	recordFile := os.Getenv("API_RECORD_FILE")
+	if recordFile == "" {
+		return nil, fmt.Errorf("API_RECORD_FILE is required when record")
+	}
+	file, err := os.OpenFile(recordFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("API_RECORD_FILE: %v", err)
+	}
+
+	return casinoapi.WithRecorder(file), nil
+}
+
+// parseDurations read durations(e.g. "30s") from env, keep the value when env empty
+func parseDurations(durations map[string]*time.Duration) error {
+	for env, d := range durations {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", env, err)
+		}
+		*d = parsed
+	}
+
+	return nil
+}
+
+// setKeepAlive read WS_PING_PERIOD, WS_PONG_WAIT and WS_IDLE_TIMEOUT(e.g. "30s"), 0 disables
+func setKeepAlive(server *gode.Server) error {
+	keepAlive := client.DefaultKeepAlive
+	durations := map[string]*time.Duration{
+		"WS_PING_PERIOD":  &keepAlive.PingPeriod,
+		"WS_PONG_WAIT":    &keepAlive.PongWait,
+		"WS_IDLE_TIMEOUT": &keepAlive.IdleTimeout,
+	}
+	if err := parseDurations(durations); err != nil {
+		return err
+	}
+	server.SetKeepAlive(keepAlive)
+
+	return nil
+}
+
+// setOutbound read WS_SEND_QUEUE_SIZE and WS_WRITE_WAIT(e.g. "10s")
+func setOutbound(server *gode.Server) error {
+	outbound := client.DefaultOutbound
+	if size := os.Getenv("WS_SEND_QUEUE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			return fmt.Errorf("WS_SEND_QUEUE_SIZE: %v", err)
+		}
+		outbound.QueueSize = n
+	}
+	if writeWait := os.Getenv("WS_WRITE_WAIT"); writeWait != "" {
+		d, err := time.ParseDuration(writeWait)
+		if err != nil {
+			return fmt.Errorf("WS_WRITE_WAIT: %v", err)
+		}
+		outbound.WriteWait = d
+	}
+	server.SetOutbound(outbound)
+
+	return nil
+}
+
+// setShutdownConcurrency read SHUTDOWN_CONCURRENCY
+func setShutdownConcurrency(server *gode.Server) error {
+	concurrency := os.Getenv("SHUTDOWN_CONCURRENCY")
+	if concurrency == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(concurrency)
+	if err != nil {
+		return fmt.Errorf("SHUTDOWN_CONCURRENCY: %v", err)
+	}
+	server.SetShutdownConcurrency(n)
+
+	return nil
+}
+
+// parseShutdownTimeout read SHUTDOWN_TIMEOUT(e.g. "30s"), default 30 seconds
+func parseShutdownTimeout() (time.Duration, error) {
+	timeout := os.Getenv("SHUTDOWN_TIMEOUT")
+	if timeout == "" {
+		return 30 * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("SHUTDOWN_TIMEOUT: %v", err)
+	}
+
+	return d, nil
+}
+
+// setClientLimits read MAX_CLIENTS and MAX_CLIENTS_PER_GAME_TYPE(e.g. "5145:50,5156:20")
+func setClientLimits(hub *gode.ClientHub) error {
+	if maxClients := os.Getenv("MAX_CLIENTS"); maxClients != "" {
+		limit, err := strconv.Atoi(maxClients)
+		if err != nil {
+			return fmt.Errorf("MAX_CLIENTS: %v", err)
+		}
+		hub.SetMaxClients(limit)
+	}
+
+	gameTypeLimits, err := parseGameTypePairs(os.Getenv("MAX_CLIENTS_PER_GAME_TYPE"))
+	if err != nil {
+		return fmt.Errorf("MAX_CLIENTS_PER_GAME_TYPE: %v", err)
+	}
+	for gameType, value := range gameTypeLimits {
+		limit, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("MAX_CLIENTS_PER_GAME_TYPE: %v", err)
+		}
+		hub.SetGameTypeLimit(gameType, limit)
+	}
+
+	return nil
+}
+
+// setRateLimits read RATE_LIMITS, action:rate:burst triples(e.g. "beginGame4:5:10,creditExchange:1:3"),
+// rate is messages per second of a user, no action limited when empty.
+func setRateLimits(server *gode.Server) error {
+	rateLimits := os.Getenv("RATE_LIMITS")
+	if rateLimits == "" {
+		return nil
+	}
+
+	limits := make(map[string]gode.RateLimit)
+	for _, triple := range strings.Split(rateLimits, ",") {
+		fields := strings.Split(strings.TrimSpace(triple), ":")
+		if len(fields) != 3 {
+			return fmt.Errorf("RATE_LIMITS: invalid limit %q", triple)
+		}
+		rate, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return fmt.Errorf("RATE_LIMITS: %v", err)
+		}
+		burst, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("RATE_LIMITS: %v", err)
+		}
+		limits[fields[0]] = gode.RateLimit{Rate: rate, Burst: burst}
+	}
+	server.SetRateLimits(limits)
+
+	return nil
+}
+
+// setDuplicateLoginPolicy read DUPLICATE_LOGIN_POLICY and DUPLICATE_LOGIN_POLICY_PER_GAME_TYPE(e.g. "5145:reject")
+func setDuplicateLoginPolicy(server *gode.Server) error {
+	if defaultPolicy := os.Getenv("DUPLICATE_LOGIN_POLICY"); defaultPolicy != "" {
+		policy, err := gode.ParseDuplicateLoginPolicy(defaultPolicy)
+		if err != nil {
+			return fmt.Errorf("DUPLICATE_LOGIN_POLICY: %v", err)
+		}
+		server.SetDuplicateLoginPolicy(policy)
+	}
+
+	gameTypePolicies, err := parseGameTypePairs(os.Getenv("DUPLICATE_LOGIN_POLICY_PER_GAME_TYPE"))
+	if err != nil {
+		return fmt.Errorf("DUPLICATE_LOGIN_POLICY_PER_GAME_TYPE: %v", err)
+	}
+	for gameType, value := range gameTypePolicies {
+		policy, err := gode.ParseDuplicateLoginPolicy(value)
+		if err != nil {
+			return fmt.Errorf("DUPLICATE_LOGIN_POLICY_PER_GAME_TYPE: %v", err)
+		}
+		server.SetGameTypeDuplicateLoginPolicy(gameType, policy)
+	}
+
+	return nil
+}
+
+// parseGameTypePairs parse "gameType:value" pairs separated by comma
+func parseGameTypePairs(pairs string) (map[types.GameType]string, error) {
+	values := make(map[types.GameType]string)
+	if pairs == "" {
+		return values, nil
+	}
+
+	for _, pair := range strings.Split(pairs, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid pair %q", pair)
+		}
+		gameType, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		values[types.GameType(gameType)] = strings.TrimSpace(kv[1])
+	}
 
-	log.Fatal(http.ListenAndServe(":80", server))
+	return values, nil
 }
@@ -0,0 +1,186 @@
+package games
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gode/types"
+)
+
+// DefaultTimeoutKey is the key of Timeouts applied to functions not listed
+const DefaultTimeoutKey = "default"
+
+// Duration unmarshal from JSON string like "3s" or "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// Timeouts of casino api functions, e.g. {"loginCheck": "3s", "default": "10s"}
+type Timeouts map[string]Duration
+
+// get returns timeout of function, or the default one, zero when both not set
+func (t Timeouts) get(function string) time.Duration {
+	if d, ok := t[function]; ok {
+		return time.Duration(d)
+	}
+
+	return time.Duration(t[DefaultTimeoutKey])
+}
+
+// Transport decide how parameters sent to flash2db
+const (
+	// TransportPath put parameters in the url path, the default
+	TransportPath = "path"
+	// TransportJSON post parameters as a JSON array
+	TransportJSON = "json"
+	// TransportForm post parameters as form values
+	TransportForm = "form"
+)
+
+var transports = map[string]bool{
+	"":            true,
+	TransportPath: true,
+	TransportJSON: true,
+	TransportForm: true,
+}
+
+// Game describe how a game type served
+type Game struct {
+	GameType types.GameType `json:"gameType"`
+	// flash2db service name, e.g. "casino.slot.line243.BuBuGaoSheng"
+	Service string `json:"service"`
+	Enabled bool   `json:"enabled"`
+	// client actions allowed, empty means all actions allowed
+	Actions []string `json:"actions"`
+	// flash2db url of this game, empty means the default one
+	Upstream string `json:"upstream"`
+	// casino api timeouts of this game, override the registry ones
+	Timeouts Timeouts `json:"timeouts"`
+	// path, json or form, empty means path
+	Transport string `json:"transport"`
+}
+
+// Allows returns true when the client action is allowed in this game
+func (g Game) Allows(action string) bool {
+	if len(g.Actions) == 0 {
+		return true
+	}
+
+	for _, a := range g.Actions {
+		if a == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Registry of games, read only after created so it's safe for concurrent use.
+type Registry struct {
+	games map[types.GameType]Game
+
+	// timeouts applied to every game
+	timeouts Timeouts
+}
+
+type registryFile struct {
+	Timeouts Timeouts `json:"timeouts"`
+	Games    []Game   `json:"games"`
+}
+
+func NewRegistry(games ...Game) (*Registry, error) {
+	r := &Registry{games: make(map[types.GameType]Game)}
+
+	for _, g := range games {
+		if g.GameType == 0 {
+			return nil, fmt.Errorf("game type is required")
+		}
+		if g.Service == "" {
+			return nil, fmt.Errorf("game %d: service is required", g.GameType)
+		}
+		if !transports[g.Transport] {
+			return nil, fmt.Errorf("game %d: unknown transport %q", g.GameType, g.Transport)
+		}
+		if _, ok := r.games[g.GameType]; ok {
+			return nil, fmt.Errorf("game %d: duplicated", g.GameType)
+		}
+		r.games[g.GameType] = g
+	}
+
+	return r, nil
+}
+
+// ParseRegistry read registry in JSON, e.g.
+//
+//	{
+//	  "timeouts": {"loginCheck": "3s", "default": "10s"},
+//	  "games": [{"gameType": 5145, "service": "casino.slot.line243.BuBuGaoSheng", "enabled": true}]
+//	}
+func ParseRegistry(reader io.Reader) (*Registry, error) {
+	file := &registryFile{}
+	decoder := json.NewDecoder(reader)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(file); err != nil {
+		return nil, fmt.Errorf("parse game registry: %v", err)
+	}
+
+	r, err := NewRegistry(file.Games...)
+	if err != nil {
+		return nil, err
+	}
+	r.timeouts = file.Timeouts
+
+	return r, nil
+}
+
+func LoadRegistry(path string) (*Registry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseRegistry(file)
+}
+
+// Game returns the registered game, disabled one included
+func (r *Registry) Game(gameType types.GameType) (Game, bool) {
+	g, ok := r.games[gameType]
+
+	return g, ok
+}
+
+// Enabled returns true when game type is registered and enabled
+func (r *Registry) Enabled(gameType types.GameType) bool {
+	g, ok := r.games[gameType]
+
+	return ok && g.Enabled
+}
+
+// Timeout returns the timeout of calling function of game type,
+// game timeouts first then registry ones, zero means not set.
+func (r *Registry) Timeout(gameType types.GameType, function string) time.Duration {
+	if g, ok := r.games[gameType]; ok {
+		if d := g.Timeouts.get(function); d > 0 {
+			return d
+		}
+	}
+
+	return r.timeouts.get(function)
+}
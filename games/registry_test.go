@@ -0,0 +1,120 @@
+package games
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"gode/types"
+)
+
+func TestParseRegistry(t *testing.T) {
+	t.Run("parse games", func(t *testing.T) {
+		registry, err := ParseRegistry(strings.NewReader(`{"games": [
+			{"gameType": 5145, "service": "casino.slot.line243.BuBuGaoSheng", "enabled": true, "actions": ["loginBySid"]},
+			{"gameType": 5156, "service": "casino.slot.crash.ZumaEmpire", "enabled": false, "upstream": "http://10.0.0.1"}
+		]}`))
+		if err != nil {
+			t.Fatalf("didn't expect an error but got one, %v", err)
+		}
+
+		g, ok := registry.Game(5145)
+		if !ok || g.Service != "casino.slot.line243.BuBuGaoSheng" || !g.Enabled {
+			t.Errorf("game 5145 not parsed correctly, got %+v", g)
+		}
+		g, ok = registry.Game(5156)
+		if !ok || g.Upstream != "http://10.0.0.1" || g.Enabled {
+			t.Errorf("game 5156 not parsed correctly, got %+v", g)
+		}
+
+		if !registry.Enabled(5145) {
+			t.Errorf("expected game 5145 enabled")
+		}
+		if registry.Enabled(5156) {
+			t.Errorf("expected game 5156 disabled")
+		}
+		if registry.Enabled(5188) {
+			t.Errorf("expected game 5188 not exists")
+		}
+	})
+
+	testCases := map[string]string{
+		"invalid json":       `{"games": [`,
+		"unknown field":      `{"games": [{"gameType": 5145, "service": "s", "servce": "s"}]}`,
+		"missing game type":  `{"games": [{"service": "s"}]}`,
+		"missing service":    `{"games": [{"gameType": 5145}]}`,
+		"duplicate gameType": `{"games": [{"gameType": 5145, "service": "s"}, {"gameType": 5145, "service": "s"}]}`,
+		"invalid timeout":    `{"timeouts": {"default": "ten seconds"}, "games": []}`,
+		"unknown transport":  `{"games": [{"gameType": 5145, "service": "s", "transport": "xml"}]}`,
+	}
+	for name, registry := range testCases {
+		t.Run("returns error when "+name, func(t *testing.T) {
+			_, err := ParseRegistry(strings.NewReader(registry))
+			if err == nil {
+				t.Errorf("expected an error but not got one")
+			}
+		})
+	}
+}
+
+func TestRegistry_Timeout(t *testing.T) {
+	registry, err := ParseRegistry(strings.NewReader(`{
+		"timeouts": {"loginCheck": "3s", "default": "10s"},
+		"games": [
+			{"gameType": 5145, "service": "s", "timeouts": {"beginGame": "500ms"}},
+			{"gameType": 5156, "service": "s", "timeouts": {"default": "20s"}},
+			{"gameType": 5188, "service": "s"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+
+	testCases := []struct {
+		gameType types.GameType
+		function string
+		want     time.Duration
+	}{
+		{5145, "beginGame", 500 * time.Millisecond},
+		{5145, "loginCheck", 3 * time.Second},
+		{5145, "onLoadInfo", 10 * time.Second},
+		{5156, "beginGame", 20 * time.Second},
+		{5188, "beginGame", 10 * time.Second},
+		{9999, "loginCheck", 3 * time.Second},
+	}
+	for _, c := range testCases {
+		if got := registry.Timeout(c.gameType, c.function); got != c.want {
+			t.Errorf("game %d %s want timeout %v, got %v", c.gameType, c.function, c.want, got)
+		}
+	}
+
+	empty, _ := NewRegistry()
+	if got := empty.Timeout(5145, "beginGame"); got != 0 {
+		t.Errorf("want zero timeout when not set, got %v", got)
+	}
+}
+
+func TestGame_Allows(t *testing.T) {
+	g := Game{Actions: []string{"loginBySid", "beginGame4"}}
+	if !g.Allows("beginGame4") {
+		t.Errorf("expected beginGame4 allowed")
+	}
+	if g.Allows("creditExchange") {
+		t.Errorf("expected creditExchange not allowed")
+	}
+
+	g = Game{}
+	if !g.Allows("creditExchange") {
+		t.Errorf("expected every action allowed when actions is empty")
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	registry, err := LoadRegistry("../games.json")
+	if err != nil {
+		t.Fatalf("could not load games.json, %v", err)
+	}
+	if !registry.Enabled(5145) || !registry.Enabled(5156) {
+		t.Errorf("expected game 5145 and 5156 enabled in games.json")
+	}
+}
@@ -2,6 +2,7 @@ package gode_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http/httptest"
 	"reflect"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"gode"
 	"gode/client"
 	"gode/types"
 )
@@ -18,10 +20,12 @@ import (
 type SpyAPI struct {
 	history  apiHistory
 	response map[string]apiResponse
-	mutex    sync.Mutex
+	// responses returned in order before falling back to response
+	queue map[string][]apiResponse
+	mutex sync.Mutex
 }
 
-func (a *SpyAPI) Call(service types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+func (a *SpyAPI) Call(_ context.Context, service types.GameType, function string, parameters ...interface{}) ([]byte, error) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 	a.history = append(a.history, apiLog{
@@ -30,6 +34,11 @@ func (a *SpyAPI) Call(service types.GameType, function string, parameters ...int
 		parameters: parameters,
 	})
 
+	if queued := a.queue[function]; len(queued) > 0 {
+		a.queue[function] = queued[1:]
+		return queued[0].result, queued[0].err
+	}
+
 	return a.response[function].result, a.response[function].err
 }
 
@@ -40,6 +49,53 @@ func (a *SpyAPI) History() apiHistory {
 	return a.history
 }
 
+// BlockingAPI blocks calls of function until ctx done, then reports ctx.Err() to canceled
+type BlockingAPI struct {
+	*SpyAPI
+	function string
+	canceled chan error
+}
+
+func (a *BlockingAPI) Call(ctx context.Context, service types.GameType, function string, parameters ...interface{}) ([]byte, error) {
+	result, err := a.SpyAPI.Call(ctx, service, function, parameters...)
+	if function != a.function {
+		return result, err
+	}
+
+	<-ctx.Done()
+	a.canceled <- ctx.Err()
+
+	return nil, ctx.Err()
+}
+
+func loginResult(uid types.UserID, hid types.HallID) []byte {
+	return []byte(fmt.Sprintf(`{"event":true, "data":{"user": {"UserID": "%d", "HallID":"%d"}, "Session":{"Session":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}}}`, uid, hid))
+}
+
+// waitForHistory wait until n calls made, fail after a second
+func waitForHistory(t *testing.T, spyAPI *SpyAPI, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(spyAPI.History()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d calls, got history %v", n, spyAPI.History())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForNumberOfClient wait until the pool has n clients, fail after two seconds
+func waitForNumberOfClient(t *testing.T, pool *gode.ClientHub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.NumberOfClients() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted number of clients %d, got %d", n, pool.NumberOfClients())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 type apiResponse struct {
 	result []byte
 	err    error
@@ -79,6 +135,23 @@ func (h *SpyHub) NumberOfClients() int {
 	return len(h.clients)
 }
 
+func (h *SpyHub) NumberOfClientsByHallID(types.HallID) int { return 0 }
+
+func (h *SpyHub) NumberOfClientsByGameType(types.GameType) int { return 0 }
+
+func (h *SpyHub) Clients() []*client.Client {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return append([]*client.Client{}, h.clients...)
+}
+
+func (h *SpyHub) ClientByUserID(types.UserID) (*client.Client, bool) { return nil, false }
+
+func (h *SpyHub) ClientsByHallID(types.HallID) []*client.Client { return nil }
+
+func (h *SpyHub) ClientsByGameType(types.GameType) []*client.Client { return nil }
+
 func (h *SpyHub) Register(c *client.Client) error {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -89,6 +162,8 @@ func (h *SpyHub) Register(c *client.Client) error {
 
 func (h *SpyHub) Unregister(client *client.Client) {}
 
+func (h *SpyHub) Close() {}
+
 func (h *SpyHub) GetClient(index int) *client.Client {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
@@ -115,6 +190,15 @@ func assertReceiveBinaryMsg(t *testing.T, dialer *websocket.Conn, want string) {
 	}
 }
 
+func assertCloseCode(t *testing.T, dialer *websocket.Conn, code int) {
+	t.Helper()
+
+	_, _, err := dialer.ReadMessage()
+	if !websocket.IsCloseError(err, code) {
+		t.Errorf("expect close with code %d, got %v", code, err)
+	}
+}
+
 func writeBinaryMsg(t *testing.T, wsClient *websocket.Conn, msg string) {
 	err := wsClient.WriteMessage(websocket.BinaryMessage, []byte(msg))
 	if err != nil {
@@ -139,6 +223,63 @@ func assertWithin(t *testing.T, d time.Duration, assert func()) {
 	}
 }
 
+type wsMessage struct {
+	data []byte
+	err  error
+}
+
+// readMessages read conn in a single goroutine until error, the error is the last message,
+// so a timed out assertion never leaves a read overlapping the next one.
+func readMessages(conn *websocket.Conn) <-chan wsMessage {
+	messages := make(chan wsMessage, 8)
+	go func() {
+		defer close(messages)
+		for {
+			_, p, err := conn.ReadMessage()
+			messages <- wsMessage{data: p, err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return messages
+}
+
+func receiveWithin(t *testing.T, d time.Duration, messages <-chan wsMessage) wsMessage {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("connection already closed")
+		}
+		return msg
+	case <-time.After(d):
+		t.Fatal("timed out")
+	}
+
+	return wsMessage{}
+}
+
+func assertReceiveWithin(t *testing.T, d time.Duration, messages <-chan wsMessage, want string) {
+	t.Helper()
+	msg := receiveWithin(t, d, messages)
+	if msg.err != nil {
+		t.Fatal("ReadMessageError", msg.err)
+	}
+	if got := string(msg.data); got != want {
+		t.Errorf("message from web socket not matched\nwant %s\n got %s", want, got)
+	}
+}
+
+func assertCloseCodeWithin(t *testing.T, d time.Duration, messages <-chan wsMessage, code int) {
+	t.Helper()
+	msg := receiveWithin(t, d, messages)
+	if !websocket.IsCloseError(msg.err, code) {
+		t.Errorf("expect close with code %d, got %v", code, msg.err)
+	}
+}
+
 func assertNoResponseWithin(t *testing.T, d time.Duration, client *websocket.Conn) {
 	t.Helper()
 	msgChan := make(chan []byte, 1)
@@ -201,14 +342,17 @@ func assertLogEqual(t *testing.T, expectedHistory, wantedLog apiHistory) {
 	}
 }
 
-func assertClientEqual(t *testing.T, want, got client.Client) {
+func assertClientEqual(t *testing.T, want, got *client.Client) {
 	t.Helper()
 	isGameTypeSame := want.GameType == got.GameType
 	isUserIDSame := want.UserID == got.UserID
 	isHallIDSame := want.HallID == got.HallID
 	isSIDSame := bytes.Compare(want.SessionID, got.SessionID) == 0
 	if !isGameTypeSame || !isUserIDSame || !isSIDSame || !isHallIDSame {
-		t.Errorf("client not equal, \nwant: %+v\n got: %+v\n", want, got)
+		t.Errorf("client not equal, \nwant: %d %d %d %s\n got: %d %d %d %s\n",
+			want.GameType, want.UserID, want.HallID, want.SessionID,
+			got.GameType, got.UserID, got.HallID, got.SessionID,
+		)
 	}
 
 }
@@ -0,0 +1,98 @@
+package gode_test
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode"
+	"gode/client"
+)
+
+func TestKeepAlive(t *testing.T) {
+	const loginMsg = `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`
+
+	newServer := func(keepAlive client.KeepAlive) (*httptest.Server, *gode.ClientHub, *SpyAPI) {
+		spyAPI := &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}}
+		pool := gode.NewClientHub()
+		svr := gode.NewServer(pool, spyAPI)
+		svr.SetKeepAlive(keepAlive)
+
+		return httptest.NewServer(svr), pool, spyAPI
+	}
+
+	// keepReading make the player respond to ping
+	keepReading := func(player *websocket.Conn) {
+		go func() {
+			for {
+				if _, _, err := player.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	keepAlive := client.KeepAlive{PingPeriod: 50 * time.Millisecond, PongWait: 200 * time.Millisecond}
+
+	t.Run("leave machine when peer not responding to ping", func(t *testing.T) {
+		server, pool, spyAPI := newServer(keepAlive)
+		defer server.Close()
+
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+		writeBinaryMsg(t, player, loginMsg)
+		waitForNumberOfClient(t, pool, 1)
+
+		// player never read, so never pong
+		waitForNumberOfClient(t, pool, 0)
+		assertCalled(t, spyAPI, "machineLeave")
+	})
+
+	t.Run("keep connection when peer responding to ping", func(t *testing.T) {
+		server, pool, _ := newServer(keepAlive)
+		defer server.Close()
+
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+		writeBinaryMsg(t, player, loginMsg)
+		keepReading(player)
+		waitForNumberOfClient(t, pool, 1)
+
+		time.Sleep(3 * keepAlive.PongWait)
+
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+	})
+
+	t.Run("leave machine when player idle too long", func(t *testing.T) {
+		idle := keepAlive
+		idle.IdleTimeout = 3 * keepAlive.PongWait
+		server, pool, spyAPI := newServer(idle)
+		defer server.Close()
+
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+		writeBinaryMsg(t, player, loginMsg)
+		keepReading(player)
+		waitForNumberOfClient(t, pool, 1)
+
+		// responding to ping keeps the connection beyond pong wait, but not beyond idle timeout
+		time.Sleep(keepAlive.PongWait + keepAlive.PingPeriod)
+		assertNumberOfClient(t, 1, pool.NumberOfClients())
+
+		waitForNumberOfClient(t, pool, 0)
+		assertCalled(t, spyAPI, "machineLeave")
+	})
+}
+
+func assertCalled(t *testing.T, spyAPI *SpyAPI, function string) {
+	t.Helper()
+	for _, l := range spyAPI.History() {
+		if l.function == function {
+			return
+		}
+	}
+	t.Errorf("expected %s called, got history %v", function, spyAPI.History())
+}
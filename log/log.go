@@ -1,10 +1,17 @@
 package log
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // rfc5424
@@ -34,27 +41,163 @@ var logText = map[int]string{
 	Nothing: "NOTHING",
 }
 
-var logger = log.New(os.Stderr, "", log.LstdFlags)
+// Format of log lines
+type Format int
 
-var level = Nothing
+const (
+	// FormatText is "[LEVEL]hh:mm:ss message key=value"
+	FormatText Format = iota
+	// FormatJSON is a JSON object per line, e.g.
+	//
+	//	{"time":"2020-08-01T12:00:00.000+08:00","level":"INFO","caller":"gode/server.go:229","message":"disconnect","userID":100}
+	FormatJSON
+)
 
-func init() {
-	logger.SetFlags(log.Ltime)
-}
+var (
+	mutex  sync.Mutex
+	output io.Writer = os.Stderr
+	format           = FormatText
+)
+
+var level = Nothing
 
 func SetLevel(logLevel int) {
 	level = logLevel
 }
 
+// SetFormat should be called before logging
+func SetFormat(logFormat Format) {
+	format = logFormat
+}
+
+// SetOutput set where the lines written, stderr by default
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	output = w
+}
+
 func Print(logLevel int, v ...interface{}) {
 	if logLevel >= level {
-		logger.SetPrefix(fmt.Sprintf("[%s]", logText[logLevel]))
-		_ = logger.Output(2, fmt.Sprint(v...))
+		write(logLevel, fmt.Sprint(v...), nil)
+	}
+}
+
+// PrintFields log message with key value pairs, e.g.
+//
+//	log.PrintFields(log.Notice, "action failed", "userID", c.UserID, "error", err)
+func PrintFields(logLevel int, message string, keysAndValues ...interface{}) {
+	if logLevel >= level {
+		write(logLevel, message, keysAndValues)
 	}
 }
 
+// Fatal log at Emergency regardless of level then exit
 func Fatal(v ...interface{}) {
-	logger.Fatal(v...)
+	write(Emergency, fmt.Sprint(v...), nil)
+	os.Exit(1)
+}
+
+// callerDepth skip write and the exported function called it
+const callerDepth = 3
+
+func write(logLevel int, message string, keysAndValues []interface{}) {
+	now := time.Now()
+	var line []byte
+	if format == FormatJSON {
+		line = formatJSON(now, logLevel, caller(callerDepth), message, keysAndValues)
+	} else {
+		line = formatText(now, logLevel, message, keysAndValues)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, _ = output.Write(line)
+}
+
+func formatText(now time.Time, logLevel int, message string, keysAndValues []interface{}) []byte {
+	b := bytes.Buffer{}
+	b.WriteString(fmt.Sprintf("[%s]%s %s", logText[logLevel], now.Format("15:04:05"), message))
+	for i := 0; i < len(keysAndValues); i += 2 {
+		value := fmt.Sprint(fieldValue(keysAndValues, i+1))
+		if value == "" || strings.ContainsAny(value, " =\"\n") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(fmt.Sprintf(" %s=%s", fieldKey(keysAndValues, i), value))
+	}
+	b.WriteString("\n")
+
+	return b.Bytes()
+}
+
+func formatJSON(now time.Time, logLevel int, caller, message string, keysAndValues []interface{}) []byte {
+	b := bytes.Buffer{}
+	b.WriteString(`{"time":`)
+	writeJSON(&b, now.Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, logText[logLevel])
+	b.WriteString(`,"caller":`)
+	writeJSON(&b, caller)
+	b.WriteString(`,"message":`)
+	writeJSON(&b, message)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		b.WriteString(",")
+		writeJSON(&b, fieldKey(keysAndValues, i))
+		b.WriteString(":")
+		writeJSON(&b, jsonValue(fieldValue(keysAndValues, i+1)))
+	}
+	b.WriteString("}\n")
+
+	return b.Bytes()
+}
+
+func fieldKey(keysAndValues []interface{}, i int) string {
+	if key, ok := keysAndValues[i].(string); ok {
+		return key
+	}
+
+	return fmt.Sprint(keysAndValues[i])
+}
+
+// fieldValue returns nil when the last key has no value
+func fieldValue(keysAndValues []interface{}, i int) interface{} {
+	if i >= len(keysAndValues) {
+		return nil
+	}
+
+	return keysAndValues[i]
+}
+
+// jsonValue write errors and Stringers(e.g. types.SessionID) as strings, others as JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return value
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(encoded)
+}
+
+// caller returns the file with its directory and line, e.g. "casinoapi/flash2db.go:85"
+func caller(depth int) string {
+	_, file, line, ok := runtime.Caller(depth)
+	if !ok {
+		return "???"
+	}
+	dir, name := filepath.Split(file)
+
+	return fmt.Sprintf("%s/%s:%d", filepath.Base(dir), name, line)
 }
 
 func ParseLogLevel(logLevel string) int {
@@ -79,3 +222,12 @@ func ParseLogLevel(logLevel string) int {
 		return Nothing
 	}
 }
+
+// ParseFormat returns FormatJSON for "json", FormatText otherwise
+func ParseFormat(logFormat string) Format {
+	if strings.ToLower(logFormat) == "json" {
+		return FormatJSON
+	}
+
+	return FormatText
+}
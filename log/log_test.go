@@ -1,6 +1,16 @@
 package log
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
 
 type TestCase struct {
 	logLevelString string
@@ -31,3 +41,64 @@ func TestParseLogLevel(t *testing.T) {
 		}
 	}
 }
+
+func TestPrintFields(t *testing.T) {
+	defer SetOutput(os.Stderr)
+	defer SetFormat(FormatText)
+	defer SetLevel(level)
+	SetLevel(Info)
+
+	t.Run("text", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		SetOutput(b)
+		SetFormat(FormatText)
+
+		PrintFields(Notice, "action failed", "userID", 100, "error", errors.New("credit not enough"))
+		Print(Debug, "filtered")
+
+		want := regexp.MustCompile(`^\[NOTICE\]\d{2}:\d{2}:\d{2} action failed userID=100 error="credit not enough"\n$`)
+		if !want.MatchString(b.String()) {
+			t.Errorf("want line matches %s, got %q", want, b.String())
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		b := &bytes.Buffer{}
+		SetOutput(b)
+		SetFormat(FormatJSON)
+
+		PrintFields(Warning, "flash2db unhealthy", "url", "http://a", "failures", 2, "error", errors.New("status 500"), "dangling")
+
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(b.Bytes(), &line); err != nil {
+			t.Fatalf("want a JSON line, got %q, %v", b.String(), err)
+		}
+		if _, err := time.Parse(time.RFC3339, line["time"].(string)); err != nil {
+			t.Errorf("want time in RFC3339, got %v", line["time"])
+		}
+		if caller := line["caller"].(string); !strings.HasPrefix(caller, "log/log_test.go:") {
+			t.Errorf("want caller of PrintFields, got %s", caller)
+		}
+		delete(line, "time")
+		delete(line, "caller")
+		want := map[string]interface{}{
+			"level":    "WARNING",
+			"message":  "flash2db unhealthy",
+			"url":      "http://a",
+			"failures": float64(2),
+			"error":    "status 500",
+			"dangling": nil,
+		}
+		if !reflect.DeepEqual(line, want) {
+			t.Errorf("want %v, got %v", want, line)
+		}
+	})
+}
+
+func TestParseFormat(t *testing.T) {
+	for format, want := range map[string]Format{"json": FormatJSON, "JSON": FormatJSON, "text": FormatText, "": FormatText} {
+		if got := ParseFormat(format); got != want {
+			t.Errorf("parsing log format %q: want %d, got %d", format, want, got)
+		}
+	}
+}
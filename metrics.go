@@ -0,0 +1,72 @@
+package gode
+
+import (
+	"strconv"
+
+	"gode/client"
+	"gode/metrics"
+)
+
+// serverMetrics count what happened to clients, methods do nothing on nil
+type serverMetrics struct {
+	messagesIn    *metrics.Counter
+	messagesOut   *metrics.Counter
+	loginFailures *metrics.Counter
+	disconnects   *metrics.Counter
+}
+
+// SetMetrics register the metrics of server and its client pool, should be called before serving.
+func (s *Server) SetMetrics(registry *metrics.Registry) {
+	s.metrics = &serverMetrics{
+		messagesIn:    registry.NewCounter("gode_ws_messages_in_total", "WS messages received by action.", "action"),
+		messagesOut:   registry.NewCounter("gode_ws_messages_out_total", "WS messages sent by action.", "action"),
+		loginFailures: registry.NewCounter("gode_login_failures_total", "Failed logins by error code, refused when the pool refused the client.", "code"),
+		disconnects:   registry.NewCounter("gode_disconnects_total", "Closed connections by reason.", "reason"),
+	}
+
+	registry.NewGaugeFunc("gode_clients", "Clients logged in by game type and hall.", []string{"game_type", "hall_id"}, func(emit metrics.Emit) {
+		for _, c := range s.clients.Clients() {
+			emit(1, strconv.Itoa(int(c.GameType)), strconv.Itoa(int(c.HallID)))
+		}
+	})
+	registry.NewCounterFunc("gode_rate_limited_total", "WS messages refused by rate limits by action.", []string{"action"}, func(emit metrics.Emit) {
+		for action, n := range s.Throttled() {
+			emit(float64(n), action)
+		}
+	})
+}
+
+func (m *serverMetrics) messageIn(action string) {
+	if m == nil {
+		return
+	}
+	// keep label values bounded
+	if !client.IsAction(action) {
+		action = "unknown"
+	}
+	m.messagesIn.Inc(action)
+}
+
+func (m *serverMetrics) messageOut(action string) {
+	if m == nil {
+		return
+	}
+	m.messagesOut.Inc(action)
+}
+
+func (m *serverMetrics) loginFailed(code string) {
+	if m == nil {
+		return
+	}
+	m.loginFailures.Inc(code)
+}
+
+func (m *serverMetrics) disconnected(reason string) {
+	if m == nil {
+		return
+	}
+	if reason == "" {
+		reason = "unknown"
+	}
+	m.disconnects.Inc(reason)
+}
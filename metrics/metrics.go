@@ -0,0 +1,326 @@
+// Package metrics write counters, gauges and histograms in Prometheus text format.
+//
+//	registry := metrics.NewRegistry()
+//	messages := registry.NewCounter("gode_ws_messages_in_total", "WS messages received.", "action")
+//	messages.Inc("beginGame4")
+//	http.Handle("/metrics", registry.Handler())
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gode/log"
+)
+
+// DefaultBuckets of latency histograms in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Emit report a sample of a collected metric, label values in the order of the labels
+type Emit func(value float64, labelValues ...string)
+
+// Registry of metrics, safe for concurrent use.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register panics when name registered twice, metrics are registered on start
+func (r *Registry) register(name string, m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write all metrics in the order registered
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mutex.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+
+	return buffered.Flush()
+}
+
+// Handler serve the metrics to Prometheus
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			log.Print(log.Notice, fmt.Sprintf("write metrics error: %v", err))
+		}
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+}
+
+// checkLabels panics when the number of label values not matched, it's a bug of the caller
+func (d *desc) checkLabels(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// Counter only goes up, a series per label values
+type Counter struct {
+	desc
+
+	mutex  sync.Mutex
+	series map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		series: make(map[string]*sample),
+	}
+	r.register(name, c)
+
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.checkLabels(labelValues)
+	key := seriesKey(labelValues)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s, ok := c.series[key]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		c.series[key] = s
+	}
+	s.value += value
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mutex.Lock()
+	samples := make([]sample, 0, len(c.series))
+	for _, s := range c.series {
+		samples = append(samples, *s)
+	}
+	c.mutex.Unlock()
+
+	c.writeHeader(w)
+	writeSamples(w, c.name, c.labels, samples)
+}
+
+// collected is a counter or gauge read from elsewhere every time written
+type collected struct {
+	desc
+	collect func(emit Emit)
+}
+
+// NewCounterFunc register a counter kept elsewhere, e.g. Server.Throttled
+func (r *Registry) NewCounterFunc(name, help string, labels []string, collect func(emit Emit)) {
+	r.register(name, &collected{desc: desc{name: name, help: help, kind: "counter", labels: labels}, collect: collect})
+}
+
+// NewGaugeFunc register a gauge read when written, e.g. number of clients
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit Emit)) {
+	r.register(name, &collected{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect})
+}
+
+func (c *collected) write(w io.Writer) {
+	// samples of the same label values added up
+	series := make(map[string]*sample)
+	c.collect(func(value float64, labelValues ...string) {
+		c.checkLabels(labelValues)
+		key := seriesKey(labelValues)
+		s, ok := series[key]
+		if !ok {
+			s = &sample{labelValues: labelValues}
+			series[key] = s
+		}
+		s.value += value
+	})
+	samples := make([]sample, 0, len(series))
+	for _, s := range series {
+		samples = append(samples, *s)
+	}
+
+	c.writeHeader(w)
+	writeSamples(w, c.name, c.labels, samples)
+}
+
+// Histogram count observations in buckets, a series per label values
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mutex  sync.Mutex
+	series map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labelValues []string
+	// observations of each bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram with upper bounds of buckets in increasing order, e.g. DefaultBuckets
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSample),
+	}
+	r.register(name, h)
+
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	key := seriesKey(labelValues)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSample{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mutex.Lock()
+	samples := make([]histogramSample, 0, len(h.series))
+	for _, s := range h.series {
+		copied := *s
+		copied.counts = append([]uint64(nil), s.counts...)
+		samples = append(samples, copied)
+	}
+	h.mutex.Unlock()
+	sort.Slice(samples, func(i, j int) bool {
+		return seriesKey(samples[i].labelValues) < seriesKey(samples[j].labelValues)
+	})
+
+	h.writeHeader(w)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, s := range samples {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", bucketLabels, append(append([]string(nil), s.labelValues...), formatValue(upper)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabels, append(append([]string(nil), s.labelValues...), "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, float64(s.count))
+	}
+}
+
+// writeSamples write samples sorted by label values so the output is stable
+func writeSamples(w io.Writer, name string, labels []string, samples []sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return seriesKey(samples[i].labelValues) < seriesKey(samples[j].labelValues)
+	})
+	for _, s := range samples {
+		writeSample(w, name, labels, s.labelValues, s.value)
+	}
+}
+
+func writeSample(w io.Writer, name string, labels, labelValues []string, value float64) {
+	b := strings.Builder{}
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(label)
+			b.WriteString(`="`)
+			b.WriteString(escapeLabelValue(labelValues[i]))
+			b.WriteString(`"`)
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" ")
+	b.WriteString(formatValue(value))
+	b.WriteString("\n")
+
+	_, _ = io.WriteString(w, b.String())
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	t.Run("counter", func(t *testing.T) {
+		r := NewRegistry()
+		c := r.NewCounter("messages_total", "Messages received.", "action")
+		c.Inc("login")
+		c.Add(2, "beginGame4")
+		c.Inc("beginGame4")
+
+		assertOutput(t, r, `# HELP messages_total Messages received.
+# TYPE messages_total counter
+messages_total{action="beginGame4"} 3
+messages_total{action="login"} 1
+`)
+	})
+
+	t.Run("gauge func adds up samples of the same labels", func(t *testing.T) {
+		r := NewRegistry()
+		r.NewGaugeFunc("clients", "Clients connected.", []string{"game_type"}, func(emit Emit) {
+			emit(1, "5145")
+			emit(1, "5156")
+			emit(1, "5145")
+		})
+
+		assertOutput(t, r, `# HELP clients Clients connected.
+# TYPE clients gauge
+clients{game_type="5145"} 2
+clients{game_type="5156"} 1
+`)
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		r := NewRegistry()
+		h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "function")
+		h.Observe(0.05, "beginGame")
+		h.Observe(0.1, "beginGame")
+		h.Observe(0.5, "beginGame")
+		h.Observe(3, "beginGame")
+
+		assertOutput(t, r, `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{function="beginGame",le="0.1"} 2
+latency_seconds_bucket{function="beginGame",le="1"} 3
+latency_seconds_bucket{function="beginGame",le="+Inf"} 4
+latency_seconds_sum{function="beginGame"} 3.65
+latency_seconds_count{function="beginGame"} 4
+`)
+	})
+
+	t.Run("escape label values and help, metrics in the order registered", func(t *testing.T) {
+		r := NewRegistry()
+		r.NewCounter("b_total", "Line one\nline two.").Inc()
+		r.NewCounter("a_total", "A.", "reason").Inc(`say "bye"` + "\n")
+
+		assertOutput(t, r, `# HELP b_total Line one\nline two.
+# TYPE b_total counter
+b_total 1
+# HELP a_total A.
+# TYPE a_total counter
+a_total{reason="say \"bye\"\n"} 1
+`)
+	})
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Inc()
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("want Prometheus text format, got %q", contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), "requests_total 1\n") {
+		t.Errorf("want requests_total in body, got %s", recorder.Body)
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	t.Run("panics when registered twice", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic but didn't get one")
+			}
+		}()
+		r := NewRegistry()
+		r.NewCounter("requests_total", "Requests.")
+		r.NewCounter("requests_total", "Requests.")
+	})
+
+	t.Run("panics when label values not matched", func(t *testing.T) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic but didn't get one")
+			}
+		}()
+		r := NewRegistry()
+		r.NewCounter("requests_total", "Requests.", "path").Inc()
+	})
+}
+
+func assertOutput(t *testing.T, r *Registry, want string) {
+	t.Helper()
+	b := strings.Builder{}
+	if err := r.Write(&b); err != nil {
+		t.Fatalf("didn't expect an error but got one, %v", err)
+	}
+	if b.String() != want {
+		t.Errorf("want\n%s\ngot\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,137 @@
+package gode
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gode/types"
+)
+
+// RateLimit is a token bucket, Burst messages at once then Rate messages per second
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitError returned when a user sends an action faster than its limit
+type RateLimitError struct {
+	UserID types.UserID
+	Action string
+	// time until the next message of the action allowed
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("user %d sends %s too fast, retry after %v", e.UserID, e.Action, e.RetryAfter)
+}
+
+// RateLimiter keep a token bucket per user and action, buckets outlive connections
+// so a user can't reset the limit by reconnecting.
+type RateLimiter struct {
+	limits map[string]RateLimit
+
+	mutex   sync.Mutex
+	buckets map[bucketKey]*bucket
+	// messages refused by action
+	throttled map[string]uint64
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+type bucketKey struct {
+	userID types.UserID
+	action string
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// NewRateLimiter limit the actions in limits, other actions are not limited
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	l := &RateLimiter{
+		limits:    make(map[string]RateLimit, len(limits)),
+		buckets:   make(map[bucketKey]*bucket),
+		throttled: make(map[string]uint64),
+		now:       time.Now,
+	}
+	for action, limit := range limits {
+		l.limits[action] = limit
+	}
+
+	return l
+}
+
+// Allow take a token of the action from the bucket of user, returns RateLimitError when empty
+func (l *RateLimiter) Allow(userID types.UserID, action string) error {
+	limit, ok := l.limits[action]
+	if !ok {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	key := bucketKey{userID: userID, action: action}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updatedAt: now}
+		l.buckets[key] = b
+	}
+	b.refill(limit, now)
+
+	if b.tokens < 1 {
+		l.throttled[action]++
+		retryAfter := time.Duration(0)
+		if limit.Rate > 0 {
+			retryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+		}
+		return &RateLimitError{UserID: userID, Action: action, RetryAfter: retryAfter}
+	}
+	b.tokens--
+
+	return nil
+}
+
+func (b *bucket) refill(limit RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.updatedAt).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.updatedAt = now
+}
+
+// sweep drop the buckets refilled, the same as new ones, at most once a minute
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		limit := l.limits[key.action]
+		b.refill(limit, now)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Throttled returns the number of messages refused by action
+func (l *RateLimiter) Throttled() map[string]uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	throttled := make(map[string]uint64, len(l.throttled))
+	for action, n := range l.throttled {
+		throttled[action] = n
+	}
+
+	return throttled
+}
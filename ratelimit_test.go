@@ -0,0 +1,61 @@
+package gode_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gode"
+	"gode/client"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	t.Run("refuse after burst and allow again after refilled", func(t *testing.T) {
+		limiter := gode.NewRateLimiter(map[string]gode.RateLimit{client.BeginGame: {Rate: 20, Burst: 2}})
+
+		assertNoError(t, limiter.Allow(100, client.BeginGame))
+		assertNoError(t, limiter.Allow(100, client.BeginGame))
+		assertRateLimited(t, limiter.Allow(100, client.BeginGame))
+
+		time.Sleep(60 * time.Millisecond)
+		assertNoError(t, limiter.Allow(100, client.BeginGame))
+	})
+
+	t.Run("limit per user and action", func(t *testing.T) {
+		limiter := gode.NewRateLimiter(map[string]gode.RateLimit{
+			client.BeginGame:      {Rate: 1, Burst: 1},
+			client.ExchangeCredit: {Rate: 1, Burst: 1},
+		})
+
+		assertNoError(t, limiter.Allow(100, client.BeginGame))
+		assertRateLimited(t, limiter.Allow(100, client.BeginGame))
+		assertNoError(t, limiter.Allow(101, client.BeginGame))
+		assertNoError(t, limiter.Allow(100, client.ExchangeCredit))
+		for i := 0; i < 10; i++ {
+			assertNoError(t, limiter.Allow(100, client.OnLoadInfo))
+		}
+	})
+
+	t.Run("count throttled messages by action", func(t *testing.T) {
+		limiter := gode.NewRateLimiter(map[string]gode.RateLimit{client.BeginGame: {Rate: 1, Burst: 1}})
+
+		for i := 0; i < 4; i++ {
+			_ = limiter.Allow(100, client.BeginGame)
+		}
+
+		if got := limiter.Throttled()[client.BeginGame]; got != 3 {
+			t.Errorf("want 3 throttled, got %d", got)
+		}
+	})
+}
+
+func assertRateLimited(t *testing.T, err error) {
+	t.Helper()
+	var rateLimitErr *gode.RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("want RateLimitError, got %v", err)
+	}
+	if rateLimitErr.RetryAfter <= 0 {
+		t.Errorf("want positive retry after, got %v", rateLimitErr.RetryAfter)
+	}
+}
@@ -1,30 +1,88 @@
 package gode
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"gode/casinoapi"
 	"gode/client"
+	"gode/games"
+	"gode/log"
 	"gode/types"
 )
 
 const dummyGameCode = types.GameCode(0)
 
+// DuplicateLoginPolicy decide what to do when a user login again with another connection.
+type DuplicateLoginPolicy int
+
+const (
+	// KickOld disconnect the connection logged in before
+	KickOld DuplicateLoginPolicy = iota
+	// RejectNew refuse the new login
+	RejectNew
+)
+
+func ParseDuplicateLoginPolicy(policy string) (DuplicateLoginPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "kick", "kick_old":
+		return KickOld, nil
+	case "reject", "reject_new":
+		return RejectNew, nil
+	}
+
+	return KickOld, fmt.Errorf("unknown duplicate login policy %q", policy)
+}
+
 type Server struct {
 	http.Handler
 
 	clients ClientPool
 
 	api casinoapi.Caller
+
+	// nil means every game type in 5000~5999 accepted and all actions allowed
+	registry *games.Registry
+
+	duplicateLoginPolicy           DuplicateLoginPolicy
+	duplicateLoginPolicyByGameType map[types.GameType]DuplicateLoginPolicy
+
+	keepAlive client.KeepAlive
+	outbound  client.Outbound
+
+	// nil means no metrics
+	metrics *serverMetrics
+
+	// nil means no action limited
+	rateLimiter *RateLimiter
+
+	// set to 1 atomically when shutdown
+	shuttingDown        int32
+	shutdownConcurrency int
+
+	// every connection, logged in or not, so all of them told when shutdown
+	connectionsMutex sync.Mutex
+	connections      map[*client.Client]struct{}
 }
 
 func NewServer(clients ClientPool, casinoAPI casinoapi.Caller) (s *Server) {
 	s = &Server{
-		clients: clients,
-		api:     casinoAPI,
+		clients:                        clients,
+		api:                            casinoAPI,
+		duplicateLoginPolicy:           KickOld,
+		duplicateLoginPolicyByGameType: make(map[types.GameType]DuplicateLoginPolicy),
+		keepAlive:                      client.DefaultKeepAlive,
+		outbound:                       client.DefaultOutbound,
+		shutdownConcurrency:            DefaultShutdownConcurrency,
+		connections:                    make(map[*client.Client]struct{}),
 	}
 
 	router := http.NewServeMux()
@@ -35,23 +93,85 @@ func NewServer(clients ClientPool, casinoAPI casinoapi.Caller) (s *Server) {
 	return
 }
 
+// SetGameRegistry set the games could be played, should be called before serving.
+func (s *Server) SetGameRegistry(registry *games.Registry) {
+	s.registry = registry
+}
+
+// SetKeepAlive set how dead peers detected, should be called before serving.
+func (s *Server) SetKeepAlive(keepAlive client.KeepAlive) {
+	s.keepAlive = keepAlive
+}
+
+// SetOutbound set the send queue size and write deadline, should be called before serving.
+func (s *Server) SetOutbound(outbound client.Outbound) {
+	s.outbound = outbound
+}
+
+// SetRateLimits limit actions per user after login, should be called before serving.
+func (s *Server) SetRateLimits(limits map[string]RateLimit) {
+	s.rateLimiter = NewRateLimiter(limits)
+}
+
+// Throttled returns the number of messages refused by rate limits by action
+func (s *Server) Throttled() map[string]uint64 {
+	if s.rateLimiter == nil {
+		return map[string]uint64{}
+	}
+
+	return s.rateLimiter.Throttled()
+}
+
+// SetDuplicateLoginPolicy set the default policy, should be called before serving.
+func (s *Server) SetDuplicateLoginPolicy(policy DuplicateLoginPolicy) {
+	s.duplicateLoginPolicy = policy
+}
+
+// SetGameTypeDuplicateLoginPolicy set policy of a game type, should be called before serving.
+func (s *Server) SetGameTypeDuplicateLoginPolicy(gameType types.GameType, policy DuplicateLoginPolicy) {
+	s.duplicateLoginPolicyByGameType[gameType] = policy
+}
+
+func (s *Server) getDuplicateLoginPolicy(gameType types.GameType) DuplicateLoginPolicy {
+	if policy, ok := s.duplicateLoginPolicyByGameType[gameType]; ok {
+		return policy
+	}
+
+	return s.duplicateLoginPolicy
+}
+
 func (s *Server) gameHandler(w http.ResponseWriter, r *http.Request) {
+	if s.isShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	gameType, _ := s.parseGameType(r)
-	if gameType < 5000 || gameType > 5999 {
+	if !s.isGameAvailable(gameType) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	c := &client.Client{}
+	// make sure every connection will get different client
+	c := &client.Client{
+		GameType:    gameType,
+		RemoteAddr:  r.RemoteAddr,
+		ConnectedAt: time.Now(),
+		KeepAlive:   s.keepAlive,
+		Outbound:    s.outbound,
+	}
 	err := c.ServeWS(w, r)
 	if err != nil {
 		return
 	}
+	if !s.track(c) {
+		s.writeMsg(c, client.ShutdownResponse, []byte(`null`))
+		c.Close(websocket.CloseGoingAway, "server shutdown")
+		return
+	}
+	defer s.untrack(c)
 
-	// make sure every connection will get different client
-	c.GameType = gameType
-
-	c.WriteMsg(client.Response(client.ReadyResponse, []byte(`null`)))
+	s.writeMsg(c, client.ReadyResponse, []byte(`null`))
 
 	// keep listen and handle ws messages
 	wsMsg := make(chan []byte)
@@ -59,14 +179,38 @@ func (s *Server) gameHandler(w http.ResponseWriter, r *http.Request) {
 	for {
 		msg, ok := <-wsMsg
 		if ok {
-			s.handleMessage(msg, c)
+			err := s.handleMessage(msg, c)
+			if isLoginRefused(err) {
+				// client never registered and machine not occupied, no need to leave
+				s.refuse(c, err)
+				for range wsMsg {
+				}
+				break
+			}
 		} else {
-			_, _ = s.api.Call(c.GameType, casinoapi.BalanceExchange, c.UserID, c.HallID, dummyGameCode)
-			_, _ = s.api.Call(c.GameType, casinoapi.MachineLeave, c.UserID, c.HallID, dummyGameCode)
-			s.clients.Unregister(c)
+			// settle with a new context, the client context already canceled
+			s.leave(context.Background(), c)
 			break
 		}
 	}
+	s.metrics.disconnected(c.CloseReason())
+}
+
+func (s *Server) isGameAvailable(gameType types.GameType) bool {
+	if s.registry == nil {
+		return gameType >= 5000 && gameType <= 5999
+	}
+
+	return s.registry.Enabled(gameType)
+}
+
+func (s *Server) isActionAllowed(gameType types.GameType, action string) bool {
+	if s.registry == nil {
+		return true
+	}
+	game, _ := s.registry.Game(gameType)
+
+	return game.Allows(action)
 }
 
 func (s *Server) parseGameType(r *http.Request) (gameType types.GameType, err error) {
@@ -76,78 +220,280 @@ func (s *Server) parseGameType(r *http.Request) (gameType types.GameType, err er
 	return types.GameType(gameTypeUint64), err
 }
 
-func (s *Server) handleMessage(msg []byte, c *client.Client) {
+// leave settle the credit and leave the machine, then unregister client.
+// only the first call takes effect.
+// the action in flight is canceled and waited, so it never lands after settled.
+func (s *Server) leave(ctx context.Context, c *client.Client) {
+	previous, ok := c.Leave()
+	if !ok {
+		return
+	}
+
+	c.Cancel()
+	if err := c.WaitIdle(ctx); err != nil {
+		log.PrintFields(log.Warning, "leave without waiting action in flight", "userID", c.UserID, "gameType", c.GameType, "error", err)
+	}
+
+	// machineOccupy may have been applied by flash2db even if it failed
+	if previous >= client.LoggedIn {
+		ctx = withClient(ctx, c)
+		_, _ = s.api.Call(ctx, c.GameType, casinoapi.BalanceExchange, c.UserID, c.HallID, dummyGameCode)
+		_, _ = s.api.Call(ctx, c.GameType, casinoapi.MachineLeave, c.UserID, c.HallID, dummyGameCode)
+	}
+	s.clients.Unregister(c)
+}
+
+// disconnect notify the player with action, close the connection and leave
+func (s *Server) disconnect(ctx context.Context, c *client.Client, action string, closeCode int, reason string) {
+	log.PrintFields(log.Info, "disconnect", "userID", c.UserID, "gameType", c.GameType, "reason", reason)
+
+	s.writeMsg(c, action, []byte(`null`))
+	c.Close(closeCode, reason)
+	s.leave(ctx, c)
+}
+
+// kick tell the player logged in elsewhere, close the connection and leave
+func (s *Server) kick(c *client.Client) {
+	s.disconnect(context.Background(), c, client.LoggedInElsewhereResponse, websocket.ClosePolicyViolation, "logged in elsewhere")
+}
+
+func isLoginRefused(err error) bool {
+	var poolFull *PoolFullError
+	var duplicate *DuplicateUserError
+
+	return errors.As(err, &poolFull) || errors.As(err, &duplicate) || errors.Is(err, ErrShuttingDown)
+}
+
+// refuse tell the player why the login refused then close the connection
+func (s *Server) refuse(c *client.Client, reason error) {
+	log.PrintFields(log.Warning, "refuse login", "userID", c.UserID, "gameType", c.GameType, "error", reason)
+
+	result, _ := json.Marshal(struct {
+		Reason string `json:"reason"`
+	}{reason.Error()})
+	s.writeMsg(c, client.LoginRefusedResponse, result)
+
+	var duplicate *DuplicateUserError
+	switch {
+	case errors.As(reason, &duplicate):
+		c.Close(websocket.ClosePolicyViolation, "already logged in")
+	case errors.Is(reason, ErrShuttingDown):
+		c.Close(websocket.CloseGoingAway, "server shutdown")
+	default:
+		c.Close(websocket.CloseTryAgainLater, "server full")
+	}
+}
+
+// register client, handle duplicate login by policy of the game type
+func (s *Server) register(c *client.Client) error {
+	err := s.clients.Register(c)
+
+	var duplicate *DuplicateUserError
+	if errors.As(err, &duplicate) && s.getDuplicateLoginPolicy(c.GameType) == KickOld {
+		s.kick(duplicate.Client)
+		err = s.clients.Register(c)
+	}
+
+	return err
+}
+
+// withClient returns a copy of ctx carrying the user and hall of a logged in client
+func withClient(ctx context.Context, c *client.Client) context.Context {
+	return casinoapi.WithHall(casinoapi.WithUser(ctx, c.UserID), c.HallID)
+}
+
+// writeMsg send the response of action to the player
+func (s *Server) writeMsg(c *client.Client, action string, result json.RawMessage) {
+	s.metrics.messageOut(action)
+	c.WriteMsg(client.Response(action, result))
+}
+
+// writeError tell the player the action failed, the full error only logged
+func (s *Server) writeError(c *client.Client, code client.ErrorCode, action string, err error) {
+	log.PrintFields(log.Notice, "action failed", "userID", c.UserID, "gameType", c.GameType, "action", action, "error", err)
+	s.metrics.messageOut(client.ErrorResponse)
+	c.WriteMsg(client.ErrorMsg(code, action, errorMessage(code, err)))
+}
+
+// errorMessage returns the message of code, or the code and message of flash2db when it refused,
+// other errors may carry internal hosts or the session id.
+func errorMessage(code client.ErrorCode, err error) string {
+	var businessError *casinoapi.BusinessError
+	if errors.As(err, &businessError) && (businessError.Code != "" || businessError.Message != "") {
+		return fmt.Sprintf("code %s: %s", businessError.Code, businessError.Message)
+	}
+
+	return code.Message()
+}
+
+func (s *Server) loginFailed(c *client.Client, code client.ErrorCode, err error) {
+	s.metrics.loginFailed(strconv.Itoa(int(code)))
+	s.writeError(c, code, client.Login, err)
+}
+
+func stateErrorCode(err *client.StateError) client.ErrorCode {
+	if err.InFlight {
+		return client.CodeActionInFlight
+	}
+
+	return client.CodeActionNotAllowed
+}
+
+// apiErrorCode tell the player game unavailable when the circuit of the game is open,
+// or the action refused when flash2db responds event false.
+func apiErrorCode(err error) client.ErrorCode {
+	var circuitOpen *casinoapi.CircuitOpenError
+	if errors.As(err, &circuitOpen) {
+		return client.CodeGameUnavailable
+	}
+	var businessError *casinoapi.BusinessError
+	if errors.As(err, &businessError) {
+		return client.CodeAPIRefused
+	}
+
+	return client.CodeAPIError
+}
+
+func (s *Server) handleMessage(msg []byte, c *client.Client) error {
 	data := client.ParseData(msg)
+	s.metrics.messageIn(data.Action)
+	// api calls canceled when the player disconnected
+	ctx := c.Context()
+	if c.State() != client.Connected {
+		ctx = withClient(ctx, c)
+	}
+	if !client.IsAction(data.Action) {
+		err := fmt.Errorf("unknown action %q", data.Action)
+		s.writeError(c, client.CodeUnknownAction, data.Action, err)
+		return err
+	}
+
+	if !s.isActionAllowed(c.GameType, data.Action) {
+		err := fmt.Errorf("action %s not supported by game %d", data.Action, c.GameType)
+		s.writeError(c, client.CodeActionNotSupported, data.Action, err)
+		return err
+	}
+
+	// users are known only after login
+	if s.rateLimiter != nil && c.State() != client.Connected {
+		if err := s.rateLimiter.Allow(c.UserID, data.Action); err != nil {
+			s.writeError(c, client.CodeRateLimited, data.Action, err)
+			return err
+		}
+	}
+
+	if err := c.Begin(data.Action); err != nil {
+		var stateErr *client.StateError
+		errors.As(err, &stateErr)
+		s.writeError(c, stateErrorCode(stateErr), data.Action, err)
+		return err
+	}
+
+	// keep reading while an exclusive action handled, so a duplicate one rejected instead of queued
+	if client.IsExclusive(data.Action) {
+		go func() {
+			defer c.End(data.Action)
+			_ = s.handleAction(ctx, c, data)
+		}()
+		return nil
+	}
+	defer c.End(data.Action)
 
+	return s.handleAction(ctx, c, data)
+}
+
+// handleAction call the api of an action began and respond the player
+func (s *Server) handleAction(ctx context.Context, c *client.Client, data *client.WSData) error {
 	switch data.Action {
 	case client.Login:
-		loginCheckResult, err := s.api.Call(c.GameType, casinoapi.LoginCheck, data.SessionID)
+		// calls of the user go to the flash2db node answered loginCheck
+		ctx = casinoapi.WithSession(ctx, data.SessionID)
+		loginCheckResult, err := s.api.Call(ctx, c.GameType, casinoapi.LoginCheck, data.SessionID)
 		if err != nil {
-			return
+			code := apiErrorCode(err)
+			if code == client.CodeAPIRefused {
+				// session invalid or expired
+				code = client.CodeLoginFailed
+			}
+			s.loginFailed(c, code, err)
+			return err
 		}
 
 		if err := storeLoginResult(loginCheckResult, c); err != nil {
-			return
+			s.loginFailed(c, client.CodeLoginFailed, err)
+			return err
+		}
+		ctx = withClient(ctx, c)
+		if err := s.register(c); err != nil {
+			// refused by gameHandler
+			s.metrics.loginFailed("refused")
+			return err
+		}
+		if err := c.Transit(client.LoggedIn); err != nil {
+			return err
 		}
-		// only return an error when reach client limit
-		_ = s.clients.Register(c)
 
-		apiResult, err := s.api.Call(c.GameType, casinoapi.MachineOccupy, c.UserID, c.HallID, dummyGameCode)
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.MachineOccupy, c.UserID, c.HallID, dummyGameCode)
 		if err != nil {
-			return
+			s.loginFailed(c, apiErrorCode(err), err)
+			// nothing allowed when logged in without machine, leave after the connection closed
+			c.Close(websocket.CloseTryAgainLater, "machine occupy failed")
+			return err
+		}
+		if err := c.Transit(client.MachineOccupied); err != nil {
+			return err
 		}
 
-		c.WriteMsg(client.Response(client.LoginResponse, loginCheckResult))
-		c.WriteMsg(client.Response(client.TakeMachineResponse, apiResult))
+		s.writeMsg(c, client.LoginResponse, loginCheckResult)
+		s.writeMsg(c, client.TakeMachineResponse, apiResult)
 
 	case client.OnLoadInfo:
-		apiResult, _ := s.api.Call(c.GameType, casinoapi.OnLoadInfo, c.UserID, dummyGameCode)
-		c.WriteMsg(client.Response(client.OnLoadInfoResponse, apiResult))
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.OnLoadInfo, c.UserID, dummyGameCode)
+		if err != nil {
+			s.writeError(c, apiErrorCode(err), data.Action, err)
+			return err
+		}
+		s.writeMsg(c, client.OnLoadInfoResponse, apiResult)
 
 	case client.GetMachineDetail:
-		apiResult, _ := s.api.Call(c.GameType, casinoapi.GetMachineDetail, c.UserID, dummyGameCode)
-		c.WriteMsg(client.Response(client.GetMachineDetailResponse, apiResult))
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.GetMachineDetail, c.UserID, dummyGameCode)
+		if err != nil {
+			s.writeError(c, apiErrorCode(err), data.Action, err)
+			return err
+		}
+		s.writeMsg(c, client.GetMachineDetailResponse, apiResult)
 
 	case client.BeginGame:
-		apiResult, err := s.api.Call(c.GameType, casinoapi.BeginGame, c.SessionID, dummyGameCode, data.BetInfo)
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.BeginGame, c.SessionID, dummyGameCode, data.BetInfo)
 		if err != nil {
-			return
+			s.writeError(c, apiErrorCode(err), data.Action, err)
+			return err
 		}
-		c.WriteMsg(client.Response(client.BeginGameResponse, apiResult))
+		s.writeMsg(c, client.BeginGameResponse, apiResult)
 
 	case client.ExchangeCredit:
-		apiResult, _ := s.api.Call(c.GameType, casinoapi.CreditExchange, c.SessionID, dummyGameCode, data.BetBase, data.Credit)
-		c.WriteMsg(client.Response(client.ExchangeCreditResponse, apiResult))
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.CreditExchange, c.SessionID, dummyGameCode, data.BetBase, data.Credit)
+		if err != nil {
+			s.writeError(c, apiErrorCode(err), data.Action, err)
+			return err
+		}
+		s.writeMsg(c, client.ExchangeCreditResponse, apiResult)
 
 	case client.ExchangeBalance:
-		apiResult, _ := s.api.Call(c.GameType, casinoapi.BalanceExchange, c.UserID, c.HallID, dummyGameCode)
-		c.WriteMsg(client.Response(client.ExchangeBalanceResponse, apiResult))
-	}
-}
-
-type LoginCheckResult struct {
-	Event bool `json:"event"`
-	Data  struct {
-		Session struct {
-			Session  types.SessionID `json:"session"`
-			CreateAt string          `json:"create_at"`
-		} `json:"session"`
-		User struct {
-			UserID       types.UserID `json:"UserID"`
-			Username     string       `json:"Username"`
-			LoginName    string       `json:"LoginName"`
-			Currency     string       `json:"Currency"`
-			Cash         string       `json:"Cash"`
-			HallID       types.HallID `json:"HallID"`
-			ExchangeRate string       `json:"ExchangeRate"`
-			Test         string       `json:"Test"`
-		} `json:"user"`
-	} `json:"data"`
+		apiResult, err := s.api.Call(ctx, c.GameType, casinoapi.BalanceExchange, c.UserID, c.HallID, dummyGameCode)
+		if err != nil {
+			s.writeError(c, apiErrorCode(err), data.Action, err)
+			return err
+		}
+		s.writeMsg(c, client.ExchangeBalanceResponse, apiResult)
+	}
+
+	return nil
 }
 
 func storeLoginResult(loginCheckResult []byte, c *client.Client) error {
-	result := &LoginCheckResult{}
-	err := json.Unmarshal(loginCheckResult, result)
+	result := &casinoapi.LoginCheckResult{}
+	err := casinoapi.Decode(casinoapi.LoginCheck, loginCheckResult, result)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,130 @@
+package gode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"gode/client"
+	"gode/log"
+)
+
+// DefaultShutdownConcurrency is the number of clients settled at the same time when shutdown
+const DefaultShutdownConcurrency = 10
+
+var ErrShuttingDown = errors.New("server shutting down")
+
+// SetShutdownConcurrency set the number of clients settled at the same time when shutdown,
+// should be called before serving.
+func (s *Server) SetShutdownConcurrency(concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	s.shutdownConcurrency = concurrency
+}
+
+func (s *Server) isShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
+// track add the connection, returns false when shutting down
+func (s *Server) track(c *client.Client) bool {
+	s.connectionsMutex.Lock()
+	defer s.connectionsMutex.Unlock()
+
+	if s.isShuttingDown() {
+		return false
+	}
+	s.connections[c] = struct{}{}
+
+	return true
+}
+
+func (s *Server) untrack(c *client.Client) {
+	s.connectionsMutex.Lock()
+	defer s.connectionsMutex.Unlock()
+
+	delete(s.connections, c)
+}
+
+// Shutdown stop accepting new connections and logins, then notify every registered client,
+// settle the credit, leave the machine and close the connection,
+// the connections not logged in are notified and closed too.
+// returns ctx.Err() when ctx done before all clients settled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connectionsMutex.Lock()
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	connections := make([]*client.Client, 0, len(s.connections))
+	for c := range s.connections {
+		connections = append(connections, c)
+	}
+	s.connectionsMutex.Unlock()
+
+	// logins after closed are refused, no client registered after listed
+	s.clients.Close()
+	clients := s.clients.Clients()
+	// settled clients are leaving, the others still connected
+	defer s.closeConnected(connections)
+
+	log.Print(log.Info, fmt.Sprintf("shutdown, settling %d clients", len(clients)))
+	if err := s.settleAll(ctx, clients); err != nil {
+		return err
+	}
+	log.Print(log.Info, fmt.Sprintf("shutdown, %d clients settled", len(clients)))
+
+	return nil
+}
+
+// closeConnected tell the connections not logged in server shutting down and close them
+func (s *Server) closeConnected(connections []*client.Client) {
+	for _, c := range connections {
+		if c.State() == client.Connected {
+			s.writeMsg(c, client.ShutdownResponse, []byte(`null`))
+			c.Close(websocket.CloseGoingAway, "server shutdown")
+		}
+	}
+}
+
+// settleAll settle clients with bounded concurrency
+func (s *Server) settleAll(ctx context.Context, clients []*client.Client) error {
+	semaphore := make(chan struct{}, s.shutdownConcurrency)
+	wg := sync.WaitGroup{}
+	for _, c := range clients {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case semaphore <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(c *client.Client) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			s.settle(ctx, c)
+		}(c)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// settle tell the player server shutting down, close the connection and leave
+func (s *Server) settle(ctx context.Context, c *client.Client) {
+	s.disconnect(ctx, c, client.ShutdownResponse, websocket.CloseGoingAway, "server shutdown")
+}
@@ -0,0 +1,116 @@
+package gode_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gode"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	const timeout = time.Second
+
+	t.Run("settle every registered client and refuse new connections", func(t *testing.T) {
+		spyAPI := &SpyAPI{queue: map[string][]apiResponse{
+			"loginCheck": {
+				{result: loginResult(100, 6)},
+				{result: loginResult(101, 6)},
+			},
+		}}
+		pool := gode.NewClientHub()
+		svr := gode.NewServer(pool, spyAPI)
+		svr.SetShutdownConcurrency(1)
+		server := httptest.NewServer(svr)
+		defer server.Close()
+
+		player1 := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player1.Close()
+		player2 := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player2.Close()
+		players := map[*websocket.Conn]<-chan wsMessage{
+			player1: readMessages(player1),
+			player2: readMessages(player2),
+		}
+		for _, player := range []*websocket.Conn{player1, player2} {
+			assertReceiveWithin(t, timeout, players[player], `{"action":"ready","result":null}`)
+			writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+			// onLogin and onTakeMachine
+			receiveWithin(t, timeout, players[player])
+			receiveWithin(t, timeout, players[player])
+		}
+		assertNumberOfClient(t, 2, pool.NumberOfClients())
+
+		err := svr.Shutdown(context.Background())
+		assertNoError(t, err)
+
+		for _, player := range []*websocket.Conn{player1, player2} {
+			assertReceiveWithin(t, timeout, players[player], `{"action":"onServerShutdown","result":null}`)
+			assertCloseCodeWithin(t, timeout, players[player], websocket.CloseGoingAway)
+		}
+		waitForProcess()
+
+		assertNumberOfClient(t, 0, pool.NumberOfClients())
+		leaves := 0
+		for _, l := range spyAPI.History() {
+			if l.function == "machineLeave" {
+				leaves++
+			}
+		}
+		if leaves != 2 {
+			t.Errorf("want 2 clients leave machine, got history %v", spyAPI.History())
+		}
+
+		_, resp, err := websocket.DefaultDialer.Dial(makeWebSocketURL(server, "/casino/5145"), nil)
+		if err == nil {
+			t.Fatalf("expected dial error after shutdown")
+		}
+		assertResponseCode(t, resp.StatusCode, http.StatusServiceUnavailable)
+	})
+
+	t.Run("notify and close connections not logged in", func(t *testing.T) {
+		spyAPI := &SpyAPI{}
+		pool := gode.NewClientHub()
+		svr := gode.NewServer(pool, spyAPI)
+		server := httptest.NewServer(svr)
+		defer server.Close()
+
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+		messages := readMessages(player)
+		assertReceiveWithin(t, timeout, messages, `{"action":"ready","result":null}`)
+
+		err := svr.Shutdown(context.Background())
+		assertNoError(t, err)
+
+		assertReceiveWithin(t, timeout, messages, `{"action":"onServerShutdown","result":null}`)
+		assertCloseCodeWithin(t, timeout, messages, websocket.CloseGoingAway)
+		if len(spyAPI.History()) != 0 {
+			t.Errorf("shouldn't call casino api, got %v", spyAPI.History())
+		}
+	})
+
+	t.Run("returns error when deadline exceeded", func(t *testing.T) {
+		pool := gode.NewClientHub()
+		svr := gode.NewServer(pool, &SpyAPI{response: map[string]apiResponse{
+			"loginCheck": {result: loginResult(100, 6)},
+		}})
+		server := httptest.NewServer(svr)
+		defer server.Close()
+
+		player := mustDialWS(t, makeWebSocketURL(server, "/casino/5145"))
+		defer player.Close()
+		writeBinaryMsg(t, player, `{"action":"loginBySid","sid":"21d9b36e42c8275a4359f6815b859df05ec2bb0a"}`)
+		waitForNumberOfClient(t, pool, 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := svr.Shutdown(ctx)
+		if err != context.Canceled {
+			t.Errorf("want error %v, got %v", context.Canceled, err)
+		}
+	})
+}